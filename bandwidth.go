@@ -0,0 +1,50 @@
+package down
+
+// bandwidthQuantum 带宽组中每次读取的最大字节数，也是限速器的 burst
+// 所有读取者每次申请相同大小的令牌，限速器按申请顺序放行，从而平分带宽
+// burst 很小时空闲的令牌不会累积，刚加入的读取者也不会被先到的读取者抢占
+const bandwidthQuantum = 16 * 1024
+
+// BandwidthGroup 带宽组，组内所有正在下载的连接共享同一个限速
+// 可以同时设置给多个 Down、Operation 或 Meta
+type BandwidthGroup struct {
+	rate *Limiter
+}
+
+// NewBandwidthGroup 创建带宽组，n 为每秒下载字节，0 为不限速
+func NewBandwidthGroup(n int) *BandwidthGroup {
+	group := &BandwidthGroup{rate: NewLimiter(Inf, 0)}
+	group.SetLimit(n)
+	return group
+}
+
+// SetLimit 修改带宽组的限速，下载中也可以修改，n 为 0 时不限速
+func (group *BandwidthGroup) SetLimit(n int) {
+	if n <= 0 {
+		group.rate.SetLimit(Inf)
+		return
+	}
+	burst := n
+	if burst > bandwidthQuantum {
+		burst = bandwidthQuantum
+	}
+	group.rate.SetBurst(burst)
+	group.rate.SetLimit(Limit(n))
+}
+
+// Limit 带宽组的限速，0 为不限速
+func (group *BandwidthGroup) Limit() int {
+	limit := group.rate.Limit()
+	if limit == Inf {
+		return 0
+	}
+	return int(limit)
+}
+
+// quantum 每次读取的最大字节数，不限速时为 0
+func (group *BandwidthGroup) quantum() int {
+	if group.rate.Limit() == Inf {
+		return 0
+	}
+	return group.rate.Burst()
+}
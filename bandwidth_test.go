@@ -0,0 +1,56 @@
+package down
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// zeroReader 无限读取 0
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// TestBandwidthGroup 测试带宽组在多个文件之间共享并平分限速
+func TestBandwidthGroup(t *testing.T) {
+	limit := 256 * 1024
+	group := NewBandwidthGroup(limit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		total = make([]int, 2)
+	)
+	for i := 0; i < len(total); i++ {
+		of := &operatFile{rate: NewLimiter(Inf, 0), groups: []*BandwidthGroup{group}}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := of.rateRead(ctx, zeroReader{}, buf)
+				if err != nil {
+					return
+				}
+				total[i] += n
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 一秒内最多读取初始的 burst 加上一秒的限速
+	sum := total[0] + total[1]
+	if sum > limit+bandwidthQuantum*2 {
+		t.Fatalf("带宽组限速失败, 一秒内读取了 %d 字节, 限速为 %d", sum, limit)
+	}
+	for i, n := range total {
+		if float64(n) < float64(sum)*0.35 {
+			t.Fatalf("带宽组分配不均, 第 %d 个文件读取 %d 字节, 总共 %d 字节", i, n, sum)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package down
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ChecksumAction 校验失败时的处理方式
+type ChecksumAction int
+
+const (
+	// ChecksumKeep 保留文件，只返回错误
+	ChecksumKeep ChecksumAction = iota
+	// ChecksumRemove 删除文件
+	ChecksumRemove
+	// ChecksumRedownload 重新下载一次，仍然失败时返回错误并保留文件
+	ChecksumRedownload
+)
+
+// Checksum 下载完成后校验文件的哈希值
+type Checksum struct {
+	// Algorithm 哈希算法，支持 md5、sha1、sha256、sha512
+	Algorithm string
+
+	// Value 十六进制的哈希值，不区分大小写
+	Value string
+
+	// OnMismatch 校验失败时的处理方式，默认为 ChecksumKeep
+	OnMismatch ChecksumAction
+}
+
+// ChecksumError 文件哈希值与 Checksum 不一致
+type ChecksumError struct {
+	// Path 文件位置
+	Path string
+
+	// Algorithm 哈希算法
+	Algorithm string
+
+	// Expected 期望的哈希值
+	Expected string
+
+	// Actual 文件实际的哈希值
+	Actual string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("文件 %s 校验失败, %s 应为 %s, 实际为 %s", e.Path, e.Algorithm, e.Expected, e.Actual)
+}
+
+// newHash 根据算法名称创建哈希
+func newHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(strings.ReplaceAll(algorithm, "-", "")) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("不支持的哈希算法 %s", algorithm)
+}
+
+// seqHasher 按文件顺序写入的数据边下载边计算哈希，避免下载完成后再读一遍文件
+// 写入位置不连续时（多线程下载或者断点续传）不再计算，校验时重新读取文件
+type seqHasher struct {
+	hash   hash.Hash
+	offset int64
+	broken bool
+	mux    sync.Mutex
+}
+
+// newSeqHasher 创建顺序哈希
+func newSeqHasher(algorithm string) (*seqHasher, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &seqHasher{hash: h}, nil
+}
+
+// write 写入 off 位置的数据
+func (sh *seqHasher) write(off int64, p []byte) {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+	if sh.broken {
+		return
+	}
+	if off != sh.offset {
+		sh.broken = true
+		return
+	}
+	sh.hash.Write(p)
+	sh.offset += int64(len(p))
+}
+
+// reset 从头开始计算
+func (sh *seqHasher) reset() {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+	sh.hash.Reset()
+	sh.offset = 0
+	sh.broken = false
+}
+
+// sum 获取大小为 size 的文件的哈希值，数据不完整时返回 false
+func (sh *seqHasher) sum(size int64) (string, bool) {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+	if sh.broken || (size > 0 && sh.offset != size) {
+		return "", false
+	}
+	return hex.EncodeToString(sh.hash.Sum(nil)), true
+}
+
+// fileHash 读取文件计算哈希值
+func fileHash(f *os.File, algorithm string) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(h, io.NewSectionReader(f, 0, math.MaxInt64))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
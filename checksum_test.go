@@ -0,0 +1,35 @@
+package down
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSeqHasher(t *testing.T) {
+	data := []byte("0123456789")
+	sum := sha1.Sum(data)
+	want := hex.EncodeToString(sum[:])
+
+	sh, err := newSeqHasher("SHA-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.write(0, data[:4])
+	sh.write(4, data[4:])
+	if got, ok := sh.sum(10); !ok || got != want {
+		t.Fatalf("顺序写入的哈希为 %s %v, 应为 %s", got, ok, want)
+	}
+
+	sh.reset()
+	sh.write(0, data[:4])
+	sh.write(6, data[6:])
+	sh.write(4, data[4:6])
+	if _, ok := sh.sum(10); ok {
+		t.Fatal("写入位置不连续时不应该返回哈希")
+	}
+
+	if _, err := newSeqHasher("crc32"); err == nil {
+		t.Fatal("不支持的算法应该返回错误")
+	}
+}
@@ -0,0 +1,64 @@
+package down
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileConflict 目标文件已存在时的处理方式
+type FileConflict int
+
+const (
+	// FileConflictDefault Meta 中为默认值时使用 Down 的设置，Down 中为默认值时根据 allowOverwrite 覆盖或者返回错误
+	FileConflictDefault FileConflict = iota
+	// FileConflictOverwrite 覆盖已存在的文件
+	FileConflictOverwrite
+	// FileConflictFail 返回 ErrorFileExist 错误
+	FileConflictFail
+	// FileConflictSkip 跳过下载，文件的状态为 StateSkipped
+	FileConflictSkip
+	// FileConflictRename 在名称之后扩展名之前加上一个点和一个数字（1..9999）作为新的文件名
+	FileConflictRename
+	// FileConflictBackup 将已存在的文件依次备份为 name.1.ext、name.2.ext，最新的备份为 name.1.ext
+	FileConflictBackup
+	// FileConflictSync 类似 wget -N，使用 Meta.ETag、上次下载记录的 ETag 和 Last-Modified 或者文件的修改时间发送条件请求，
+	// 服务器返回 304 时跳过下载，否则覆盖已存在的文件
+	// 下载完成后文件的修改时间设置为远程资源的修改时间，支持扩展属性时记录 ETag 和 Last-Modified
+	FileConflictSync
+)
+
+// MAXFILENUMBER 自动重命名和备份时最大的数字
+const MAXFILENUMBER = 9999
+
+// numberedPath 在名称之后扩展名之前加上一个点和一个数字
+func numberedPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// renamePath 获取第一个不存在的重命名文件，exists 判断文件是否被占用
+func renamePath(path string, exists func(string) bool) (string, error) {
+	for i := 1; i <= MAXFILENUMBER; i++ {
+		newpath := numberedPath(path, i)
+		if !exists(newpath) {
+			return newpath, nil
+		}
+	}
+	return "", fmt.Errorf(ErrorFileExist, path)
+}
+
+// backupPath 将已存在的文件备份为 name.1.ext，之前的备份数字依次加一
+func backupPath(path string) error {
+	last := 1
+	for last < MAXFILENUMBER && fileExist(numberedPath(path, last)) {
+		last++
+	}
+	for i := last; i > 1; i-- {
+		if err := os.Rename(numberedPath(path, i-1), numberedPath(path, i)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(path, numberedPath(path, 1))
+}
@@ -0,0 +1,42 @@
+package down
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileConflict 测试自动重命名和备份的文件名
+func TestFileConflict(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "down.tar.gz")
+	if got := numberedPath(path, 3); got != filepath.Join(dir, "down.tar.3.gz") {
+		t.Fatalf("重命名的文件为 %s", got)
+	}
+
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(path, "new")
+	write(numberedPath(path, 1), "old")
+
+	got, err := renamePath(path, fileExist)
+	if err != nil || got != numberedPath(path, 2) {
+		t.Fatalf("自动重命名为 %s %v, 应为 %s", got, err, numberedPath(path, 2))
+	}
+
+	if err := backupPath(path); err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range map[int]string{1: "new", 2: "old"} {
+		data, err := os.ReadFile(numberedPath(path, n))
+		if err != nil || string(data) != want {
+			t.Fatalf("备份 %d 的内容为 %s %v, 应为 %s", n, data, err, want)
+		}
+	}
+	if fileExist(path) {
+		t.Fatal("备份后原文件应该不存在")
+	}
+}
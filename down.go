@@ -2,6 +2,8 @@ package down
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/http"
@@ -14,40 +16,83 @@ import (
 type Down struct {
 	// perHooks 是返回下载进度的钩子，默认为空
 	perHooks []PerHook
+	// middlewares 请求中间件，每个请求发送前按顺序调用，默认为空
+	middlewares []RequestMiddleware
 	// sendTime 给 Hook 发送下载进度的间隔时间，默认为 500ms
 	sendTime time.Duration
 	// threadCount 多线程下载时最多同时下载一个文件的最大线程，默认为 1
 	threadCount int
+	// adaptiveThread 是否根据下载速度自动调整连接数，threadCount 为连接数上限，默认为 false
+	adaptiveThread bool
 	// threadSize 多线程下载时每个线程下载的大小，每个线程都会有一个自己下载大小的缓冲区，默认为 20M
 	threadSize int
 	// diskCache 磁盘缓冲区大小，默认为 16M
 	diskCache int
-	// speedLimit 下载速度限制，默认为 0 无限制
+	// speedLimit 每个文件的下载速度限制，默认为 0 无限制
 	speedLimit int
+	// bandwidthGroup 带宽组，所有文件共享限速，默认为 nil
+	bandwidthGroup *BandwidthGroup
 	// createDir 当需要创建目录时，是否创建目录，默认为 true
 	createDir bool
-	// allowOverwrite 是否允许覆盖文件，默认为 true
+	// allowOverwrite 是否允许覆盖文件，fileConflict 为 FileConflictDefault 时使用，默认为 true
 	allowOverwrite bool
-	// autoFileRenaming 文件自动重命名，新文件名在名称之后扩展名之前加上一个点和一个数字（1..9999）。默认:true
-	autoFileRenaming bool
+	// fileConflict 目标文件已存在时的处理方式，默认为 FileConflictDefault 根据 allowOverwrite 覆盖或者返回错误
+	fileConflict FileConflict
 	// continuew 是否启用断点续传，默认为 true
 	continuew bool
+	// adoptPartial 没有控制文件时，是否将比远程资源小的已有文件当作已下载的部分继续下载，默认为 false
+	adoptPartial bool
 	// autoSaveTnterval 自动保存控制文件的时间，默认为 1 秒
 	autoSaveTnterval time.Duration
+	// syncPolicy 下载的文件刷入磁盘的策略，默认为 SyncInterval
+	syncPolicy SyncPolicy
 	// connectTimeout HTTP 连接请求的超时时间，默认为 5 秒
 	connectTimeout time.Duration
-	// timeout 下载总超时时间，默认为 10 分钟
+	// timeout 下载总超时时间，默认为 10 分钟，暂停期间不计入
 	timeout time.Duration
+	// lowSpeedLimit 连接每秒下载字节数低于该值持续 lowSpeedTime 时重新连接，默认为 0 不检测
+	lowSpeedLimit int
+	// lowSpeedTime 低速持续的时间，默认为 30 秒
+	lowSpeedTime time.Duration
 	// retryNumber 最多重试次数，默认为 5
 	retryNumber int
 	// retryTime 重试时的间隔时间，默认为 0
 	retryTime time.Duration
 	// proxy Http 代理设置，默认为 http.ProxyFromEnvironment
 	proxy func(*http.Request) (*url.URL, error)
+	// tlsConfig TLS 配置，默认为 nil 验证服务器证书
+	tlsConfig *tls.Config
+	// rootCAs 验证服务器证书的根证书，默认为 nil 使用系统的根证书
+	rootCAs *x509.CertPool
+	// clientCerts 双向认证的客户端证书，默认为空
+	clientCerts []tls.Certificate
+	// pins 每个 host 的证书公钥固定，默认为空
+	pins map[string][]string
+	// insecureSkipVerify 是否跳过服务器证书验证，默认为 false
+	insecureSkipVerify bool
+	// transport 自定义的 RoundTripper，默认为 nil 使用 sharedTransport
+	transport http.RoundTripper
+	// sharedTransport 所有下载共享的 Transport，第一次使用时创建，修改相关设置后重新创建
+	sharedTransport *http.Transport
+	// maxConnsPerHost 与每个 host 的最大连接数，默认为 0 不限制
+	maxConnsPerHost int
+	// maxIdleConnsPerHost 与每个 host 保留的最大空闲连接数，默认为 16
+	maxIdleConnsPerHost int
+	// idleConnTimeout 空闲连接的超时时间，默认为 90 秒
+	idleConnTimeout time.Duration
 	// tempFileExt 临时文件后缀, 默认为 down
 	tempFileExt string
-	// mux 锁
-	mux sync.Mutex
+	// partFileExt 下载中的文件后缀，下载成功后重命名为目标文件，为空时直接下载到目标文件，默认为 part
+	partFileExt string
+	// remoteTime 下载完成后是否将文件的修改时间设置为远程资源的 Last-Modified，默认为 false
+	remoteTime bool
+	// xattr 下载完成后是否将下载地址、Content-Type 和 ETag 记录到文件的扩展属性，只支持 Linux，默认为 false
+	xattr bool
+	// aria2ControlFile 是否同时写入 aria2 格式的控制文件（下载中的文件名加 .aria2），默认为 false
+	// 不论是否开启，没有控制文件但有 aria2 控制文件时都会使用 aria2 控制文件断点续传
+	aria2ControlFile bool
+	// mux 锁，使用指针防止拷贝 Down 时复制锁
+	mux *sync.Mutex
 }
 
 var (
@@ -56,32 +101,58 @@ var (
 
 	// Error 自定义错误
 	ErrorDefault       = "down error: %v"
+	ErrorWrap          = "down error: %w"
 	ErrorFileExist     = "已存在文件 %s，若允许替换文件请将 down.AllowOverwrite 设为 true"
 	ErrorRequestStatus = "%s HTTP Status Code %d"
+	ErrorControlFile   = "控制文件 %s 已损坏或者不是控制文件"
+	ErrorPinMismatch   = "%s 的证书公钥与固定的公钥不一致"
+	ErrorPinHost       = "%s 设置了公钥固定，但 TLS 握手的 ServerName 为 %s，无法检查公钥"
+	ErrorSizeMismatch  = "%s 的文件大小 %d 与 %d 不一致"
+	ErrorLowSpeed      = "%s 的下载速度低于 %d 字节/秒持续 %s"
 	ErrInvalidWrite    = errors.New("invalid write result")
+
+	// errRemoteChanged 下载中远程资源发生变化
+	errRemoteChanged = errors.New("远程资源已发生变化")
+)
+
+// SyncPolicy 下载的文件刷入磁盘的策略
+// 控制文件只记录保存前已经写入文件的数据，下载的文件刷入磁盘后再写入控制文件，断电后续传时不会缺少数据
+type SyncPolicy int
+
+const (
+	// SyncNever 不主动刷入磁盘，由操作系统决定，断电后控制文件可能记录了没有写入磁盘的数据
+	SyncNever SyncPolicy = iota
+	// SyncInterval 每次自动保存控制文件时刷入磁盘
+	SyncInterval
+	// SyncBlock 除了自动保存，每个数据块下载完成时也刷入磁盘并保存控制文件
+	SyncBlock
 )
 
 // New 创建一个默认的下载器
 func New() *Down {
 	return &Down{
-		perHooks:         make([]PerHook, 0),
-		sendTime:         time.Millisecond * 500,
-		threadCount:      1,
-		threadSize:       20971520,
-		diskCache:        16777216,
-		speedLimit:       0,
-		createDir:        true,
-		allowOverwrite:   true,
-		continuew:        true,
-		autoFileRenaming: true,
-		autoSaveTnterval: time.Second * 1,
-		connectTimeout:   time.Second * 5,
-		timeout:          time.Minute * 10,
-		retryNumber:      5,
-		retryTime:        0,
-		proxy:            http.ProxyFromEnvironment,
-		tempFileExt:      "down",
-		mux:              sync.Mutex{},
+		perHooks:            make([]PerHook, 0),
+		sendTime:            time.Millisecond * 500,
+		threadCount:         1,
+		threadSize:          20971520,
+		diskCache:           16777216,
+		speedLimit:          0,
+		createDir:           true,
+		allowOverwrite:      true,
+		continuew:           true,
+		autoSaveTnterval:    time.Second * 1,
+		syncPolicy:          SyncInterval,
+		connectTimeout:      time.Second * 5,
+		timeout:             time.Minute * 10,
+		lowSpeedTime:        time.Second * 30,
+		retryNumber:         5,
+		retryTime:           0,
+		proxy:               http.ProxyFromEnvironment,
+		maxIdleConnsPerHost: 16,
+		idleConnTimeout:     time.Second * 90,
+		tempFileExt:         "down",
+		partFileExt:         "part",
+		mux:                 &sync.Mutex{},
 	}
 }
 
@@ -179,6 +250,13 @@ func (down *Down) SetSpeedLimit(n int) {
 	down.speedLimit = n
 }
 
+// SetBandwidthGroup 设置带宽组，该下载器的所有下载与组内的其他下载共享限速，nil 为取消
+func (down *Down) SetBandwidthGroup(n *BandwidthGroup) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.bandwidthGroup = n
+}
+
 // SetThreadCount 设置多线程时的最大线程数
 func (down *Down) SetThreadCount(n int) {
 	down.mux.Lock()
@@ -186,6 +264,13 @@ func (down *Down) SetThreadCount(n int) {
 	down.threadCount = n
 }
 
+// SetAdaptiveThread 设置是否根据下载速度自动调整连接数，开启后 SetThreadCount 设置的是连接数上限
+func (down *Down) SetAdaptiveThread(n bool) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.adaptiveThread = n
+}
+
 // SetThreadCount 设置多线程时每个线程下载的最大长度
 func (down *Down) SetThreadSize(n int) {
 	down.mux.Lock()
@@ -214,6 +299,13 @@ func (down *Down) SetAllowOverwrite(n bool) {
 	down.allowOverwrite = n
 }
 
+// SetFileConflict 设置目标文件已存在时的处理方式，Meta.FileConflict 不为 FileConflictDefault 时使用 Meta 的设置
+func (down *Down) SetFileConflict(n FileConflict) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.fileConflict = n
+}
+
 // SetContinue 设置是否启用断点续传
 func (down *Down) SetContinue(n bool) {
 	down.mux.Lock()
@@ -221,6 +313,21 @@ func (down *Down) SetContinue(n bool) {
 	down.continuew = n
 }
 
+// SetAdoptPartial 设置没有控制文件时，是否使用已有的文件继续下载
+// 开启后比远程资源小的文件会被当作已下载的开头部分，只下载剩余的部分，可以通过 Meta.ETag 确认文件属于同一个资源
+func (down *Down) SetAdoptPartial(n bool) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.adoptPartial = n
+}
+
+// SetSyncPolicy 设置下载的文件刷入磁盘的策略
+func (down *Down) SetSyncPolicy(n SyncPolicy) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.syncPolicy = n
+}
+
 // SetAutoSaveTnterval 设置自动保存控制文件的时间
 func (down *Down) SetAutoSaveTnterval(n time.Duration) {
 	down.mux.Lock()
@@ -233,15 +340,25 @@ func (down *Down) SetConnectTimeout(n time.Duration) {
 	down.mux.Lock()
 	defer down.mux.Unlock()
 	down.connectTimeout = n
+	down.resetTransport()
 }
 
-// SetTimeout 设置下载总超时时间
+// SetTimeout 设置下载总超时时间，暂停期间不计入
 func (down *Down) SetTimeout(n time.Duration) {
 	down.mux.Lock()
 	defer down.mux.Unlock()
 	down.timeout = n
 }
 
+// SetLowSpeedLimit 设置低速检测，支持断点续传的连接每秒下载字节数低于 n 持续 t 时，从已下载的位置重新连接
+// n 为 0 时不检测，限速下载时 n 应小于限速
+func (down *Down) SetLowSpeedLimit(n int, t time.Duration) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.lowSpeedLimit = n
+	down.lowSpeedTime = t
+}
+
 // SetRetryNumber 设置下载最多重试次数
 func (down *Down) SetRetryNumber(n int) {
 	down.mux.Lock()
@@ -261,6 +378,7 @@ func (down *Down) SetProxy(n func(*http.Request) (*url.URL, error)) {
 	down.mux.Lock()
 	defer down.mux.Unlock()
 	down.proxy = n
+	down.resetTransport()
 }
 
 // SetTempFileExt 设置临时文件后缀
@@ -270,6 +388,35 @@ func (down *Down) SetTempFileExt(n string) {
 	down.tempFileExt = n
 }
 
+// SetPartFileExt 设置下载中的文件后缀，为空时直接下载到目标文件
+func (down *Down) SetPartFileExt(n string) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.partFileExt = n
+}
+
+// SetRemoteTime 设置下载完成后是否将文件的修改时间设置为远程资源的 Last-Modified
+func (down *Down) SetRemoteTime(n bool) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.remoteTime = n
+}
+
+// SetXattr 设置下载完成后是否记录文件的来源到扩展属性
+// 属性为 user.xdg.origin.url、user.mime_type 和 user.etag，只支持 Linux
+func (down *Down) SetXattr(n bool) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.xattr = n
+}
+
+// SetAria2ControlFile 设置是否同时写入 aria2 格式的控制文件
+func (down *Down) SetAria2ControlFile(n bool) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.aria2ControlFile = n
+}
+
 // Copy 在执行下载前，会拷贝 Down
 func (down *Down) Copy() *Down {
 	down.mux.Lock()
@@ -279,7 +426,10 @@ func (down *Down) Copy() *Down {
 	tmpDown.perHooks = make([]PerHook, len(down.perHooks))
 	copy(tmpDown.perHooks, down.perHooks)
 
-	tmpDown.mux = sync.Mutex{}
+	tmpDown.middlewares = make([]RequestMiddleware, len(down.middlewares))
+	copy(tmpDown.middlewares, down.middlewares)
+
+	tmpDown.mux = &sync.Mutex{}
 	return &tmpDown
 }
 
@@ -290,6 +440,13 @@ func (down *Down) AddHook(perhook PerHook) {
 	down.perHooks = append(down.perHooks, perhook)
 }
 
+// AddMiddleware 添加请求中间件，按添加的顺序调用，在 Meta 的中间件之前调用
+func (down *Down) AddMiddleware(m ...RequestMiddleware) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.middlewares = append(down.middlewares, m...)
+}
+
 // RunContext 基于 context 执行下载，阻塞等待完成
 func (down *Down) runContext(ctx context.Context, meta *Meta) (string, error) {
 	outpath, err := down.runMergingContext(ctx, []*Meta{meta})
@@ -324,7 +481,7 @@ func (down *Down) runMergingContext(ctx context.Context, meta []*Meta) ([]string
 func (down *Down) mergingStartContext(ctx context.Context, meta []*Meta) (*Operation, error) {
 	operat := down.operation(ctx, meta)
 	if err := operat.start(); err != nil {
-		return nil, fmt.Errorf(ErrorDefault, err)
+		return nil, fmt.Errorf(ErrorWrap, err)
 	}
 	return &Operation{operat: operat}, nil
 }
@@ -338,11 +495,43 @@ type Operation struct {
 func (o *Operation) Wait() ([]string, error) {
 	err := o.operat.wait()
 	if err != nil {
-		return o.operat.getOutpath(), fmt.Errorf(ErrorDefault, err)
+		return o.operat.getOutpath(), fmt.Errorf(ErrorWrap, err)
 	}
 	return o.operat.getOutpath(), nil
 }
 
+// Stat 获取当前的下载状态，包括每个文件及其数据块的下载进度
+func (o *Operation) Stat() *Stat {
+	return o.operat.stat()
+}
+
+// SetSpeedLimit 修改下载中每个文件的限速，每秒下载字节，0 为不限速
+func (o *Operation) SetSpeedLimit(n int) {
+	o.operat.setSpeedLimit(n)
+}
+
+// SetThreadCount 修改下载中每个文件的最大线程数
+// 减少线程数时，正在下载的数据块完成后才会减少连接
+func (o *Operation) SetThreadCount(n int) {
+	o.operat.setThreadCount(n)
+}
+
+// SetBandwidthGroup 将下载中的所有文件加入带宽组，nil 为取消
+func (o *Operation) SetBandwidthGroup(n *BandwidthGroup) {
+	o.operat.setBandwidthGroup(n)
+}
+
+// Pause 暂停下载，所有下载线程退出、写缓冲区写入磁盘并保存控制文件后返回
+// 暂停期间不计入下载总超时时间
+func (o *Operation) Pause() {
+	o.operat.pause()
+}
+
+// Resume 恢复暂停的下载，支持断点续传的文件从已下载的位置继续，否则重新下载
+func (o *Operation) Resume() {
+	o.operat.resume()
+}
+
 // operation 创建 operation
 func (down *Down) operation(ctx context.Context, meta []*Meta) *operation {
 	var operat *operation
@@ -350,6 +539,8 @@ func (down *Down) operation(ctx context.Context, meta []*Meta) *operation {
 	for i := 0; i < len(meta); i++ {
 		tmpMeta[i] = meta[i].Copy()
 	}
+	// 先创建共享的 Transport，拷贝的配置使用同一个 Transport
+	down.roundTripper()
 	// 组合操作结构,将配置拷贝一份
 	operat = newOperation(ctx, down.Copy(), tmpMeta)
 	return operat
@@ -4,14 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -119,21 +127,884 @@ func TestDown(t *testing.T) {
 		if err != nil {
 			log.Panic(err)
 		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("多线程-下载到临时文件", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		down.SetThreadCount(3)
+
+		operat, err := down.Start(meta...)
+		if err != nil {
+			log.Panic(err)
+		}
+		time.Sleep(time.Millisecond * 300)
+		path := filepath.Join(outpath, "down0.bin")
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			log.Panic("下载中目标文件不应该存在")
+		}
+		if _, err := os.Stat(path + ".part"); err != nil {
+			log.Panic(err)
+		}
+		paths, err := operat.Wait()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(paths[0], 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+			log.Panic("下载完成后临时文件没有重命名")
+		}
+		fmt.Println("文件下载完成：", paths)
+	})
+
+	t.Run("文件已存在时跳过和自动重命名", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+		defer down.SetFileConflict(down.FileConflictDefault)
+
+		down.SetThreadCount(3)
+		os.MkdirAll(outpath, os.ModePerm)
+		path := filepath.Join(outpath, "conflict.bin")
+		if err := os.WriteFile(path, []byte("exist"), 0600); err != nil {
+			log.Panic(err)
+		}
+
+		down.SetFileConflict(down.FileConflictSkip)
+		operat, err := down.Start("http://127.0.0.1:25427/down.bin", outpath, "conflict.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if _, err := operat.Wait(); err != nil {
+			log.Panic(err)
+		}
+		if state := operat.Stat().Files[0].State; state != down.StateSkipped {
+			log.Panicf("跳过下载后状态为 %s", state)
+		}
+
+		down.SetFileConflict(down.FileConflictRename)
+		renamed, err := down.Run("http://127.0.0.1:25427/down.bin", outpath, "conflict.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if filepath.Base(renamed) != "conflict.1.bin" {
+			log.Panicf("自动重命名为 %s", renamed)
+		}
+		if err := checkTestFile(renamed, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != "exist" {
+			log.Panic("已存在的文件被修改")
+		}
+	})
+
+	t.Run("文件已存在时下载成功后备份", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		os.MkdirAll(outpath, os.ModePerm)
+		path := filepath.Join(outpath, "backup.bin")
+		if err := os.WriteFile(path, []byte("exist"), 0600); err != nil {
+			log.Panic(err)
+		}
+
+		mydown := down.New()
+		mydown.SetThreadCount(1)
+		mydown.SetRetryNumber(1)
+		mydown.SetFileConflict(down.FileConflictBackup)
+
+		// 下载失败时不备份已存在的文件
+		if _, err := mydown.Run("http://127.0.0.1:25427/drop.bin", outpath, "backup.bin"); err == nil {
+			log.Panic("连接中断后没有返回错误")
+		}
+		if data, _ := os.ReadFile(path); string(data) != "exist" {
+			log.Panic("下载失败后已存在的文件被修改")
+		}
+		if _, err := os.Stat(filepath.Join(outpath, "backup.1.bin")); !os.IsNotExist(err) {
+			log.Panic("下载失败后备份了已存在的文件")
+		}
+
+		path, err := mydown.Run("http://127.0.0.1:25427/drop.bin", outpath, "backup.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(outpath, "backup.1.bin")); string(data) != "exist" {
+			log.Panic("已存在的文件没有备份")
+		}
+	})
+
+	t.Run("同步模式-文件是最新的时跳过", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+		defer down.SetFileConflict(down.FileConflictDefault)
+
+		down.SetThreadCount(3)
+		down.SetFileConflict(down.FileConflictSync)
+
+		for _, want := range []down.State{down.StateFinished, down.StateSkipped} {
+			operat, err := down.Start("http://127.0.0.1:25427/sync.bin", outpath, "sync.bin")
+			if err != nil {
+				log.Panic(err)
+			}
+			paths, err := operat.Wait()
+			if err != nil {
+				log.Panic(err)
+			}
+			if state := operat.Stat().Files[0].State; state != want {
+				log.Panicf("下载后状态为 %s, 应为 %s", state, want)
+			}
+			if err := checkTestFile(paths[0], 1024<<17); err != nil {
+				log.Panic(err)
+			}
+		}
+	})
+
+	t.Run("同步模式-使用上次下载记录的版本", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetThreadCount(3)
+		mydown.SetFileConflict(down.FileConflictSync)
+
+		// 远程资源更新后重新下载，不能用下载完成的时间作为 If-Modified-Since
+		for _, test := range []struct {
+			uri  string
+			want down.State
+		}{
+			{"http://127.0.0.1:25427/sync.bin", down.StateFinished},
+			{"http://127.0.0.1:25427/sync2021.bin", down.StateFinished},
+			{"http://127.0.0.1:25427/sync2021.bin", down.StateSkipped},
+		} {
+			operat, err := mydown.Start(test.uri, outpath, "synced.bin")
+			if err != nil {
+				log.Panic(err)
+			}
+			if _, err := operat.Wait(); err != nil {
+				log.Panic(err)
+			}
+			if state := operat.Stat().Files[0].State; state != test.want {
+				log.Panicf("%s 下载后状态为 %s, 应为 %s", test.uri, state, test.want)
+			}
+		}
+
+		// 支持扩展属性时使用记录的 ETag
+		for _, want := range []down.State{down.StateFinished, down.StateSkipped} {
+			operat, err := mydown.Start("http://127.0.0.1:25427/etag.bin", outpath, "etag.bin")
+			if err != nil {
+				log.Panic(err)
+			}
+			paths, err := operat.Wait()
+			if err != nil {
+				log.Panic(err)
+			}
+			if state := operat.Stat().Files[0].State; state != want {
+				if runtime.GOOS != "linux" {
+					break
+				}
+				log.Panicf("下载后状态为 %s, 应为 %s", state, want)
+			}
+			if err := checkTestFile(paths[0], 1024<<17); err != nil {
+				log.Panic(err)
+			}
+		}
+	})
+
+	t.Run("保留远程资源的修改时间", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+		defer down.SetRemoteTime(false)
+		defer down.SetXattr(false)
+
+		down.SetThreadCount(3)
+		down.SetRemoteTime(true)
+		down.SetXattr(true)
+
+		path, err := down.Run("http://127.0.0.1:25427/sync.bin", outpath, "sync.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Panic(err)
+		}
+		if mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC); !info.ModTime().Equal(mtime) {
+			log.Panicf("文件修改时间为 %s, 应为 %s", info.ModTime(), mtime)
+		}
+	})
+
+	t.Run("多线程-按数据块刷入磁盘", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+		defer down.SetSyncPolicy(down.SyncInterval)
+
+		down.SetThreadCount(3)
+		down.SetSyncPolicy(down.SyncBlock)
+
+		path, err := down.Run(meta...)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("多线程-下载中途失败", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, time.Second*1)()
+
+		down.SetThreadCount(3)
+
+		path, err := down.Run(meta...)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		log.Panic("文件下载完成：" + path)
+	})
+
+	t.Run("多线程-暂停恢复", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		down.SetThreadCount(3)
+
+		operat, err := down.Start(meta...)
+		if err != nil {
+			log.Panic(err)
+		}
+		time.Sleep(time.Millisecond * 500)
+		operat.Pause()
+		stat := operat.Stat()
+		if len(stat.Files) != 1 || stat.Files[0].State != down.StatePaused {
+			log.Panicf("暂停后状态错误: %+v", stat.Files)
+		}
+		completed := int64(0)
+		for _, block := range stat.Files[0].Blocks {
+			completed += block.Completed
+		}
+		if completed != stat.Files[0].CompletedLength {
+			log.Panicf("数据块已下载大小 %d 与文件已下载大小 %d 不一致", completed, stat.Files[0].CompletedLength)
+		}
+		time.Sleep(time.Millisecond * 500)
+		operat.Resume()
+
+		path, err := operat.Wait()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path[0], 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：", path)
+	})
+
+	t.Run("多线程-暂停后查看控制文件", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetThreadCount(3)
+		mydown.SetThreadSize(1024 << 14)
+		mydown.SetSpeedLimit(1024 << 14)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		operat, err := mydown.StartContext(ctx, meta...)
+		if err != nil {
+			log.Panic(err)
+		}
+		// 等待有下载进度后再暂停
+		deadline := time.Now().Add(time.Second * 10)
+		for operat.Stat().CompletedLength == 0 {
+			if time.Now().After(deadline) {
+				log.Panic("等待下载进度超时")
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		operat.Pause()
+		stat := operat.Stat()
+
+		ctlpath := filepath.Join(outpath, "down0.bin.down")
+		info, err := down.InspectControlFile(ctlpath)
+		if err != nil {
+			log.Panic(err)
+		}
+		if info.URI != meta[0] || info.OutputName != "down0.bin" || info.ThreadSize != 1024<<14 ||
+			info.TotalLength != 1024<<17 || info.CreatedAt.IsZero() || info.HeadersHash == "" ||
+			info.CompletedLength != stat.Files[0].CompletedLength || info.CompletedLength == 0 || len(info.Blocks) == 0 {
+			log.Panicf("控制文件信息错误 %+v", info)
+		}
+		if _, err := json.Marshal(info); err != nil {
+			log.Panic(err)
+		}
+
+		cancel()
+		operat.Wait()
+
+		// 不完整的控制文件返回错误
+		data, err := os.ReadFile(ctlpath)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := os.WriteFile(ctlpath, data[:len(data)-10], 0600); err != nil {
+			log.Panic(err)
+		}
+		if _, err := down.InspectControlFile(ctlpath); err == nil {
+			log.Panic("不完整的控制文件应该返回错误")
+		}
+	})
+
+	t.Run("暂停期间不计入超时时间", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetTimeout(time.Second * 3)
+
+		operat, err := mydown.Start("http://127.0.0.1:25427/stalled.bin", outpath, "stalled.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		operat.Pause()
+		time.Sleep(time.Second * 4)
+		operat.Resume()
+		time.Sleep(time.Millisecond * 500)
+		if state := operat.Stat().Files[0].State; state != down.StateDownloading {
+			log.Panicf("暂停超过超时时间后恢复，状态为 %s", state)
+		}
+
+		// 下载中的时间仍然计入超时时间
+		if _, err := operat.Wait(); !errors.Is(err, context.DeadlineExceeded) {
+			log.Panicf("下载超时返回 %v", err)
+		}
+	})
+
+	t.Run("单线程-不知道文件大小时请求整个文件", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		for _, name := range []string{"unknown.bin", "norange.bin"} {
+			for _, threadCount := range []int{1, 3} {
+				mydown := down.New()
+				mydown.SetThreadCount(threadCount)
+				path, err := mydown.Run("http://127.0.0.1:25427/"+name, outpath, fmt.Sprintf("%d%s", threadCount, name))
+				if err != nil {
+					log.Panic(err)
+				}
+				if err := checkTestFile(path, 1024<<17); err != nil {
+					log.Panic(err)
+				}
+				fmt.Println("文件下载完成：" + path)
+			}
+		}
+	})
+
+	t.Run("下载中修改限速和线程数", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+		defer down.SetSpeedLimit(0)
+
+		down.SetThreadCount(1)
+		down.SetSpeedLimit(1024 << 10)
+
+		operat, err := down.Start(meta...)
+		if err != nil {
+			log.Panic(err)
+		}
+		time.Sleep(time.Millisecond * 500)
+		operat.SetSpeedLimit(0)
+		operat.SetThreadCount(3)
+		time.Sleep(time.Millisecond * 500)
+		if stat := operat.Stat(); stat.Connections <= 1 {
+			log.Panicf("修改线程数后连接数为 %d", stat.Connections)
+		}
+
+		path, err := operat.Wait()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path[0], 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：", path)
+	})
+
+	t.Run("多线程-低速重连", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+		defer down.SetLowSpeedLimit(0, time.Second*30)
+
+		down.SetThreadCount(3)
+		down.SetLowSpeedLimit(1024, time.Second*2)
+
+		path, err := down.Run("http://127.0.0.1:25427/stall.bin", outpath, "stall.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("多线程-持续低速时返回错误", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetThreadCount(3)
+		mydown.SetRetryNumber(2)
+		mydown.SetLowSpeedLimit(4096, time.Second)
+
+		_, err := mydown.Run("http://127.0.0.1:25427/stalled.bin", outpath, "stalled.bin")
+		if err == nil || !regexp.MustCompile("下载速度低于").MatchString(err.Error()) {
+			log.Panicf("持续低速时返回的错误为 %v", err)
+		}
+	})
+
+	t.Run("多线程-限速低于低速阈值时不断开", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		rt := &countTransport{rt: http.DefaultTransport}
+		mydown := down.New()
+		mydown.SetTransport(rt)
+		mydown.SetThreadCount(3)
+		mydown.SetSpeedLimit(256 << 10)
+		mydown.SetLowSpeedLimit(1024<<10, time.Second*2)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		operat, err := mydown.StartContext(ctx, meta...)
+		if err != nil {
+			log.Panic(err)
+		}
+		time.Sleep(time.Second * 5)
+		// 一个探测请求和三个数据块的请求
+		if n := atomic.LoadInt64(&rt.n); n > 4 {
+			log.Panicf("限速的连接被断开重连，共请求 %d 次", n)
+		}
+		cancel()
+		operat.Wait()
+	})
+
+	t.Run("多线程-连接中断后续传", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		down.SetThreadCount(3)
+
+		path, err := down.Run("http://127.0.0.1:25427/drop.bin", outpath, "drop.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("单线程-连接中断后续传", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetThreadCount(1)
+		mydown.SetRetryTime(time.Millisecond * 100)
+
+		path, err := mydown.Run("http://127.0.0.1:25427/drop.bin", outpath, "drop.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
 		fmt.Println("文件下载完成：" + path)
 	})
 
-	t.Run("多线程-下载中途失败", func(t *testing.T) {
+	t.Run("多线程-远程资源变化后重新下载", func(t *testing.T) {
 		defer remove()
-		defer testserver(t, time.Second*1)()
+		defer testserver(t, 0)()
 
 		down.SetThreadCount(3)
 
-		path, err := down.Run(meta...)
+		path, err := down.Run("http://127.0.0.1:25427/changed.bin", outpath, "changed.bin")
 		if err != nil {
-			fmt.Println(err)
-			return
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("多线程-远程资源大小变化后重新下载", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		// 统计镜像的数据块请求
+		mirrorCount := int64(0)
+		mydown := down.New()
+		mydown.SetThreadCount(3)
+		mydown.SetTransport(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if r.URL.Path == "/mirror.bin" && r.Header.Get("range") != "bytes=0-9" {
+				atomic.AddInt64(&mirrorCount, 1)
+			}
+			return http.DefaultTransport.RoundTrip(r)
+		}))
+
+		operat, err := mydown.StartMeta(&down.Meta{
+			URI:        "http://127.0.0.1:25427/resized.bin",
+			Mirrors:    []string{"http://127.0.0.1:25427/mirror.bin"},
+			OutputDir:  outpath,
+			OutputName: "resized.bin",
+			Method:     http.MethodGet,
+			Perm:       0600,
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		paths, err := operat.Wait()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(paths[0], 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		if stat := operat.Stat(); stat.TotalLength != 1024<<17 || stat.Files[0].TotalLength != 1024<<17 {
+			log.Panicf("重新下载后文件大小为 %d %d", stat.TotalLength, stat.Files[0].TotalLength)
+		}
+		if atomic.LoadInt64(&mirrorCount) == 0 {
+			log.Panic("重新下载后没有重新检查镜像")
+		}
+		fmt.Println("文件下载完成：", paths)
+	})
+
+	t.Run("多线程-使用aria2控制文件续传", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		down.SetThreadCount(3)
+
+		// 前 40 个 1M 的分片已经由 aria2 下载完成
+		size := int64(1024 << 17)
+		path := filepath.Join(outpath, "aria2.bin")
+		os.MkdirAll(outpath, os.ModePerm)
+		data := append(testdata(0, 40<<20-1), make([]byte, size-40<<20)...)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			log.Panic(err)
+		}
+		aria2 := new(bytes.Buffer)
+		bitfield := make([]byte, 16)
+		copy(bitfield, []byte{0xff, 0xff, 0xff, 0xff, 0xff})
+		for _, v := range []any{uint16(1), uint32(0), uint32(0), uint32(1 << 20), uint64(size), uint64(0), uint32(16), bitfield, uint32(0)} {
+			binary.Write(aria2, binary.BigEndian, v)
+		}
+		if err := os.WriteFile(path+".aria2", aria2.Bytes(), 0600); err != nil {
+			log.Panic(err)
+		}
+
+		operat, err := down.Start("http://127.0.0.1:25427/down.bin", outpath, "aria2.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if completed := operat.Stat().Files[0].CompletedLength; completed < 40<<20 {
+			log.Panicf("导入 aria2 控制文件后已下载大小为 %d", completed)
+		}
+		paths, err := operat.Wait()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(paths[0], size); err != nil {
+			log.Panic(err)
+		}
+		if _, err := os.Stat(path + ".aria2"); !os.IsNotExist(err) {
+			log.Panic("下载完成后 aria2 控制文件没有删除")
+		}
+		fmt.Println("文件下载完成：", paths)
+	})
+
+	t.Run("多线程-导出aria2控制文件", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetThreadCount(3)
+		mydown.SetSpeedLimit(1024 << 14)
+		mydown.SetAria2ControlFile(true)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		operat, err := mydown.StartContext(ctx, "http://127.0.0.1:25427/down.bin", outpath, "export.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		time.Sleep(time.Millisecond * 500)
+		operat.Pause()
+
+		// aria2 的控制文件与下载中的文件同名
+		path := filepath.Join(outpath, "export.bin")
+		if _, err := os.Stat(path + ".part.aria2"); err != nil {
+			log.Panic(err)
+		}
+		if _, err := os.Stat(path + ".aria2"); !os.IsNotExist(err) {
+			log.Panic("aria2 控制文件与下载中的文件不同名")
+		}
+		cancel()
+		operat.Wait()
+	})
+
+	t.Run("多线程-使用没有控制文件的文件续传", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+		defer down.SetAdoptPartial(false)
+
+		down.SetThreadCount(3)
+		down.SetAdoptPartial(true)
+
+		size := int64(1024 << 17)
+		os.MkdirAll(outpath, os.ModePerm)
+		if err := os.WriteFile(filepath.Join(outpath, "partial.bin"), testdata(0, 30<<20-1), 0600); err != nil {
+			log.Panic(err)
+		}
+
+		operat, err := down.Start("http://127.0.0.1:25427/down.bin", outpath, "partial.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if completed := operat.Stat().Files[0].CompletedLength; completed < 30<<20 {
+			log.Panicf("使用已有文件后已下载大小为 %d", completed)
+		}
+		paths, err := operat.Wait()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(paths[0], size); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：", paths)
+
+		// 与远程资源一样大的文件不当作已下载的部分，按文件已存在处理
+		if err := os.WriteFile(filepath.Join(outpath, "full.bin"), make([]byte, size), 0600); err != nil {
+			log.Panic(err)
+		}
+		path, err := down.Run("http://127.0.0.1:25427/down.bin", outpath, "full.bin")
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, size); err != nil {
+			log.Panic(err)
+		}
+	})
+
+	t.Run("多线程-镜像下载", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		down.SetThreadCount(4)
+
+		path, err := down.RunMeta(&down.Meta{
+			URI:        "http://127.0.0.1:25427/down.bin",
+			Mirrors:    []string{"http://127.0.0.1:25427/mirror.bin", "http://127.0.0.1:25427/notfound.bin"},
+			OutputDir:  outpath,
+			OutputName: "mirror.bin",
+			Method:     http.MethodGet,
+			Perm:       0600,
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("下载后校验文件", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		sum := sha256.Sum256(testdata(0, 1024<<17-1))
+		for _, threadCount := range []int{1, 3} {
+			down.SetThreadCount(threadCount)
+			path, err := down.RunMeta(&down.Meta{
+				URI:        "http://127.0.0.1:25427/down.bin",
+				OutputDir:  outpath,
+				OutputName: fmt.Sprintf("checksum%d.bin", threadCount),
+				Method:     http.MethodGet,
+				Perm:       0600,
+				Checksum:   &down.Checksum{Algorithm: "sha256", Value: hex.EncodeToString(sum[:])},
+			})
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Println("文件下载完成：" + path)
+		}
+
+		_, err := down.RunMeta(&down.Meta{
+			URI:        "http://127.0.0.1:25427/down.bin",
+			OutputDir:  outpath,
+			OutputName: "mismatch.bin",
+			Method:     http.MethodGet,
+			Perm:       0600,
+			Checksum:   &down.Checksum{Algorithm: "md5", Value: "00000000000000000000000000000000", OnMismatch: down.ChecksumRemove},
+		})
+		var checksumErr *down.ChecksumError
+		if !errors.As(err, &checksumErr) {
+			log.Panicf("校验失败时返回的错误为 %v", err)
+		}
+		if _, err := os.Stat(checksumErr.Path); !os.IsNotExist(err) {
+			log.Panic("校验失败后文件没有删除")
+		}
+	})
+
+	t.Run("多线程-自定义Transport", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		rt := &countTransport{rt: http.DefaultTransport}
+		mydown := down.New()
+		mydown.SetThreadCount(3)
+		mydown.SetTransport(rt)
+
+		path, err := mydown.Run(meta...)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		if atomic.LoadInt64(&rt.n) == 0 {
+			log.Panic("没有使用自定义的 Transport")
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("多线程-请求中间件签名", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetThreadCount(3)
+		mydown.SetRetryNumber(2)
+		mydown.AddMiddleware(down.RequestMiddlewareFunc(func(req *http.Request) error {
+			req.Header.Set("x-token", "token")
+			return nil
+		}))
+
+		signed := int64(0)
+		path, err := mydown.RunMeta(&down.Meta{
+			URI:        "http://127.0.0.1:25427/unsigned.bin",
+			OutputDir:  outpath,
+			OutputName: "signed.bin",
+			Method:     http.MethodGet,
+			Perm:       0600,
+			Middlewares: []down.RequestMiddleware{down.RequestMiddlewareFunc(func(req *http.Request) error {
+				atomic.AddInt64(&signed, 1)
+				req.URL.Path = "/signed.bin"
+				req.Header.Set("x-signature", testSignature(req.Header.Get("x-token"), req.Header.Get("range")))
+				return nil
+			})},
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		if atomic.LoadInt64(&signed) < 2 {
+			log.Panic("重试时没有重新调用中间件")
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("多线程-刷新过期的下载地址", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetThreadCount(4)
+		mydown.SetThreadSize(1024 << 14)
+
+		resolved := int64(0)
+		path, err := mydown.RunMeta(&down.Meta{
+			OutputDir:  outpath,
+			OutputName: "expiring.bin",
+			Method:     http.MethodGet,
+			Perm:       0600,
+			URLResolver: func(ctx context.Context) (string, http.Header, error) {
+				atomic.AddInt64(&resolved, 1)
+				res, err := http.Get("http://127.0.0.1:25427/token")
+				if err != nil {
+					return "", nil, err
+				}
+				defer res.Body.Close()
+				token, err := io.ReadAll(res.Body)
+				if err != nil {
+					return "", nil, err
+				}
+				return "http://127.0.0.1:25427/expiring.bin?token=" + string(token), nil, nil
+			},
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := checkTestFile(path, 1024<<17); err != nil {
+			log.Panic(err)
+		}
+		if atomic.LoadInt64(&resolved) < 2 {
+			log.Panic("地址过期后没有重新获取")
+		}
+		fmt.Println("文件下载完成：" + path)
+	})
+
+	t.Run("多线程-POST请求下载", func(t *testing.T) {
+		defer remove()
+		defer testserver(t, 0)()
+
+		mydown := down.New()
+		mydown.SetThreadCount(3)
+		mydown.SetThreadSize(1024 << 15)
+
+		metas := []*down.Meta{{
+			URI:        "http://127.0.0.1:25427/post.bin",
+			OutputDir:  outpath,
+			OutputName: "post1.bin",
+			Method:     http.MethodPost,
+			Body:       bytes.NewBufferString("report=1"),
+			Perm:       0600,
+		}, {
+			URI:        "http://127.0.0.1:25427/post.bin",
+			OutputDir:  outpath,
+			OutputName: "post2.bin",
+			Method:     http.MethodPost,
+			GetBody: func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewBufferString("report=1")), nil
+			},
+			Perm: 0600,
+		}}
+		for _, meta := range metas {
+			path, err := mydown.RunMeta(meta)
+			if err != nil {
+				log.Panic(err)
+			}
+			if err := checkTestFile(path, 1024<<17); err != nil {
+				log.Panic(err)
+			}
+			fmt.Println("文件下载完成：" + path)
 		}
-		log.Panic("文件下载完成：" + path)
 	})
 
 	t.Run("多线程-正常合并下载", func(t *testing.T) {
@@ -151,71 +1022,221 @@ func TestDown(t *testing.T) {
 
 }
 
+// testSignature 测试服务器要求的请求签名
+func testSignature(token, rangeHeader string) string {
+	sum := sha256.Sum256([]byte(token + "|" + rangeHeader))
+	return hex.EncodeToString(sum[:])
+}
+
+// roundTripperFunc 将函数作为 RoundTripper 使用
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// countTransport 统计请求次数的 RoundTripper
+type countTransport struct {
+	n  int64
+	rt http.RoundTripper
+}
+
+func (ct *countTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&ct.n, 1)
+	return ct.rt.RoundTrip(r)
+}
+
+// testdata 测试服务器返回的文件内容，第 i 个字节为 i % 251
+func testdata(start, end int64) []byte {
+	data := make([]byte, end-start+1)
+	for i := range data {
+		data[i] = byte((start + int64(i)) % 251)
+	}
+	return data
+}
+
+// checkTestFile 检查下载的文件内容是否与测试服务器一致
+func checkTestFile(path string, size int64) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("文件大小为 %d, 应为 %d", len(data), size)
+	}
+	if !bytes.Equal(data, testdata(0, size-1)) {
+		return fmt.Errorf("文件 %s 内容与测试服务器不一致", path)
+	}
+	return nil
+}
+
 func testserver(t *testing.T, timeout time.Duration) func() {
 	ctx, cancel := context.WithCancel(context.Background())
 	if timeout != 0 {
 		ctx, cancel = context.WithTimeout(context.Background(), timeout)
 	}
+	// 先监听端口再返回，防止下载时服务器还没有启动
+	ln, err := net.Listen("tcp", ":25427")
+	if err != nil {
+		t.Fatal(err)
+	}
 	done := make(chan bool)
-	go rundownserve(t, ctx, done)
+	go rundownserve(t, ctx, ln, done)
 	return func() {
 		cancel()
 		<-done
 	}
 }
 
-func rundownserve(t *testing.T, ctx context.Context, done chan bool) {
+func rundownserve(t *testing.T, ctx context.Context, ln net.Listener, done chan bool) {
 
 	size := 1024 << 17
 
 	handmux := http.NewServeMux()
 
 	handmux.HandleFunc("/down.bin", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodHead {
-			w.Header().Add("Accept-Ranges", "bytes")
-			w.Header().Add("Content-Length", fmt.Sprint(size))
+		serveTestFile(w, r, size, "")
+	})
+
+	handmux.HandleFunc("/mirror.bin", func(w http.ResponseWriter, r *http.Request) {
+		serveTestFile(w, r, size, "")
+	})
+
+	// 支持条件请求的文件
+	syncData := testdata(0, int64(size)-1)
+	handmux.HandleFunc("/sync.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "sync.bin", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(syncData))
+	})
+
+	// sync.bin 在 2021 年更新后的版本
+	handmux.HandleFunc("/sync2021.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "sync.bin", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(syncData))
+	})
+
+	// 只支持 ETag 的条件请求
+	handmux.HandleFunc("/etag.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("etag", `"e1"`)
+		http.ServeContent(w, r, "etag.bin", time.Time{}, bytes.NewReader(syncData))
+	})
+
+	// 前两个请求返回旧版本的文件，之后文件被替换为新版本，If-Range 不匹配时返回完整内容
+	changeCount := int32(0)
+	handmux.HandleFunc("/changed.bin", func(w http.ResponseWriter, r *http.Request) {
+		etag, fault := `"v2"`, ""
+		if atomic.AddInt32(&changeCount, 1) <= 2 {
+			etag, fault = `"v1"`, "invert"
+		}
+		w.Header().Set("etag", etag)
+		if ifRange := r.Header.Get("if-range"); ifRange != "" && ifRange != etag {
+			r.Header.Del("range")
+		}
+		serveTestFile(w, r, size, fault)
+	})
+
+	// 要求请求带有 range 请求头的签名，第一个请求返回 403
+	signedCount := int32(0)
+	handmux.HandleFunc("/signed.bin", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&signedCount, 1) == 1 || r.Header.Get("x-signature") != testSignature(r.Header.Get("x-token"), r.Header.Get("range")) {
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-		headRange := r.Header.Get("range")
-		var buf *bytes.Buffer
-		if headRange != "" {
-			rgxrange := regexp.MustCompile(`bytes=(\d+)-(\d+)`).FindStringSubmatch(headRange)
-			if len(rgxrange) != 3 {
-				w.WriteHeader(500)
-				return
-			}
-			start, err := strconv.ParseInt(rgxrange[1], 10, 0)
-			if err != nil {
-				w.WriteHeader(500)
-				return
-			}
-			end, err := strconv.ParseInt(rgxrange[2], 10, 0)
-			if err != nil {
-				w.WriteHeader(500)
-				return
-			}
-			w.Header().Add("content-range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
-			w.Header().Add("content-length", fmt.Sprint(end-start+1))
-			w.WriteHeader(206)
-			buf = bytes.NewBuffer(make([]byte, end-start+1))
-		} else {
-			w.WriteHeader(200)
-			w.Header().Add("Content-Length", fmt.Sprint(size))
-			buf = bytes.NewBuffer(make([]byte, size))
+		serveTestFile(w, r, size, "")
+	})
+
+	// 地址中的 token 每使用 3 次过期，过期后返回 403，/token 返回当前的 token
+	token, tokenCount := int32(1), int32(0)
+	handmux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, atomic.LoadInt32(&token))
+	})
+	handmux.HandleFunc("/expiring.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != strconv.Itoa(int(atomic.LoadInt32(&token))) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if atomic.AddInt32(&tokenCount, 1)%3 == 0 {
+			atomic.AddInt32(&token, 1)
+		}
+		serveTestFile(w, r, size, "")
+	})
+
+	// 只接受带有完整 Body 的 POST 请求
+	handmux.HandleFunc("/post.bin", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || string(body) != "report=1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		serveTestFile(w, r, size, "")
+	})
+
+	// range 请求的 Content-Range 没有文件总大小
+	handmux.HandleFunc("/unknown.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "" {
+			w.Header().Set("content-range", "bytes 0-9/*")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(testdata(0, 9))
+			return
 		}
-		io.Copy(w, &down.IoProxyReader{Reader: bufio.NewReaderSize(buf, 1024), Send: func(n int) {
-			time.Sleep(time.Duration(time.Millisecond) * 1)
-		}})
+		serveTestFile(w, r, size, "")
+	})
+
+	// 不支持 range 请求
+	handmux.HandleFunc("/norange.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("accept-ranges", "none")
+		r.Header.Del("range")
+		serveTestFile(w, r, size, "")
+	})
+
+	// 数据块的连接都只返回少量数据后停止响应
+	handmux.HandleFunc("/stalled.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "bytes=0-9" {
+			serveTestFile(w, r, size, "stall")
+			return
+		}
+		serveTestFile(w, r, size, "")
+	})
+
+	// 前两个请求返回一半大小的旧版本文件，之后替换为完整大小的新版本
+	resizeCount := int32(0)
+	handmux.HandleFunc("/resized.bin", func(w http.ResponseWriter, r *http.Request) {
+		etag, resize := `"v2"`, size
+		if atomic.AddInt32(&resizeCount, 1) <= 2 {
+			etag, resize = `"v1"`, size/2
+		}
+		w.Header().Set("etag", etag)
+		if ifRange := r.Header.Get("if-range"); ifRange != "" && ifRange != etag {
+			r.Header.Del("range")
+		}
+		serveTestFile(w, r, resize, "")
+	})
+
+	// 第一个数据块的连接只返回少量数据后停止响应
+	stallCount := int32(0)
+	handmux.HandleFunc("/stall.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "bytes=0-9" && atomic.AddInt32(&stallCount, 1) == 1 {
+			serveTestFile(w, r, size, "stall")
+			return
+		}
+		serveTestFile(w, r, size, "")
+	})
+
+	// 前两个数据块的连接返回少量数据后断开
+	dropCount := int32(0)
+	handmux.HandleFunc("/drop.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "bytes=0-9" && atomic.AddInt32(&dropCount, 1) <= 2 {
+			serveTestFile(w, r, size, "drop")
+			return
+		}
+		serveTestFile(w, r, size, "")
 	})
 
 	serve := &http.Server{
-		Addr:         ":25427",
 		Handler:      handmux,
 		ReadTimeout:  500 * time.Second,
 		WriteTimeout: 500 * time.Second,
 	}
 
-	go serve.ListenAndServe()
+	go serve.Serve(ln)
 
 	<-ctx.Done()
 
@@ -224,3 +1245,59 @@ func rundownserve(t *testing.T, ctx context.Context, done chan bool) {
 	done <- true
 
 }
+
+// serveTestFile 返回测试文件
+// fault 为 stall 时只返回少量数据后停止响应，为 drop 时返回少量数据后断开连接，为 invert 时返回按位取反的内容
+func serveTestFile(w http.ResponseWriter, r *http.Request, size int, fault string) {
+	if r.Method == http.MethodHead {
+		w.Header().Add("Accept-Ranges", "bytes")
+		w.Header().Add("Content-Length", fmt.Sprint(size))
+		return
+	}
+	headRange := r.Header.Get("range")
+	var buf *bytes.Buffer
+	if headRange != "" {
+		rgxrange := regexp.MustCompile(`bytes=(\d+)-(\d+)`).FindStringSubmatch(headRange)
+		if len(rgxrange) != 3 {
+			w.WriteHeader(500)
+			return
+		}
+		start, err := strconv.ParseInt(rgxrange[1], 10, 0)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		end, err := strconv.ParseInt(rgxrange[2], 10, 0)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Add("content-range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		w.Header().Add("content-length", fmt.Sprint(end-start+1))
+		w.WriteHeader(206)
+		buf = bytes.NewBuffer(testdata(start, end))
+	} else {
+		w.WriteHeader(200)
+		w.Header().Add("Content-Length", fmt.Sprint(size))
+		buf = bytes.NewBuffer(testdata(0, int64(size)-1))
+	}
+	switch fault {
+	case "stall":
+		w.Write(buf.Next(1024))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		return
+	case "drop":
+		w.Write(buf.Next(1024 << 10))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	case "invert":
+		data := buf.Bytes()
+		for i := range data {
+			data[i] = ^data[i]
+		}
+	}
+	io.Copy(w, &down.IoProxyReader{Reader: bufio.NewReaderSize(buf, 1024), Send: func(n int) {
+		time.Sleep(time.Duration(time.Millisecond) * 1)
+	}})
+}
@@ -2,6 +2,8 @@ package down
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"net/http"
 	"net/url"
 	"time"
@@ -83,6 +85,11 @@ func SetThreadCount(n int) {
 	std.SetThreadCount(n)
 }
 
+// SetAdaptiveThread 设置是否根据下载速度自动调整连接数，开启后 SetThreadCount 设置的是连接数上限
+func SetAdaptiveThread(n bool) {
+	std.SetAdaptiveThread(n)
+}
+
 // SetThreadCount 设置多线程时每个线程下载的最大长度
 func SetThreadSize(n int) {
 	std.SetThreadSize(n)
@@ -103,16 +110,36 @@ func SetAllowOverwrite(n bool) {
 	std.SetAllowOverwrite(n)
 }
 
+// SetFileConflict 设置目标文件已存在时的处理方式
+func SetFileConflict(n FileConflict) {
+	std.SetFileConflict(n)
+}
+
 // SetContinue 设置是否启用断点续传
 func SetContinue(n bool) {
 	std.SetContinue(n)
 }
 
+// SetAdoptPartial 设置没有控制文件时，是否使用已有的文件继续下载
+func SetAdoptPartial(n bool) {
+	std.SetAdoptPartial(n)
+}
+
+// SetSyncPolicy 设置下载的文件刷入磁盘的策略
+func SetSyncPolicy(n SyncPolicy) {
+	std.SetSyncPolicy(n)
+}
+
 // SetSpeedLimit 设置限速，每秒下载字节
 func SetSpeedLimit(n int) {
 	std.SetSpeedLimit(n)
 }
 
+// SetBandwidthGroup 设置带宽组，所有下载与组内的其他下载共享限速，nil 为取消
+func SetBandwidthGroup(n *BandwidthGroup) {
+	std.SetBandwidthGroup(n)
+}
+
 // SetAutoSaveTnterval 设置自动保存控制文件的时间
 func SetAutoSaveTnterval(n time.Duration) {
 	std.SetAutoSaveTnterval(n)
@@ -128,6 +155,12 @@ func SetTimeout(n time.Duration) {
 	std.SetTimeout(n)
 }
 
+// SetLowSpeedLimit 设置低速检测，支持断点续传的连接每秒下载字节数低于 n 持续 t 时，从已下载的位置重新连接
+// n 为 0 时不检测，限速下载时 n 应小于限速
+func SetLowSpeedLimit(n int, t time.Duration) {
+	std.SetLowSpeedLimit(n, t)
+}
+
 // SetRetryNumber 设置下载最多重试次数
 func SetRetryNumber(n int) {
 	std.SetRetryNumber(n)
@@ -143,11 +176,71 @@ func SetProxy(n func(*http.Request) (*url.URL, error)) {
 	std.SetProxy(n)
 }
 
+// SetTLSConfig 设置 TLS 配置，默认验证服务器证书
+func SetTLSConfig(n *tls.Config) {
+	std.SetTLSConfig(n)
+}
+
+// SetRootCAs 设置验证服务器证书的根证书
+func SetRootCAs(n *x509.CertPool) {
+	std.SetRootCAs(n)
+}
+
+// SetClientCertificate 设置双向认证的客户端证书
+func SetClientCertificate(n ...tls.Certificate) {
+	std.SetClientCertificate(n...)
+}
+
+// SetPins 设置 host 的证书公钥固定
+func SetPins(host string, pins ...string) {
+	std.SetPins(host, pins...)
+}
+
+// SetInsecureSkipVerify 设置是否跳过服务器证书验证
+func SetInsecureSkipVerify(n bool) {
+	std.SetInsecureSkipVerify(n)
+}
+
+// SetTransport 设置请求使用的 RoundTripper，为 nil 时使用共享的 Transport
+func SetTransport(n http.RoundTripper) {
+	std.SetTransport(n)
+}
+
+// SetMaxConnsPerHost 设置与每个 host 的最大连接数，0 为不限制
+func SetMaxConnsPerHost(n int) {
+	std.SetMaxConnsPerHost(n)
+}
+
+// SetIdleConns 设置与每个 host 保留的最大空闲连接数和空闲连接的超时时间
+func SetIdleConns(n int, timeout time.Duration) {
+	std.SetIdleConns(n, timeout)
+}
+
 // SetTempFileExt 设置临时文件后缀
 func SetTempFileExt(n string) {
 	std.SetTempFileExt(n)
 }
 
+// SetPartFileExt 设置下载中的文件后缀，为空时直接下载到目标文件
+func SetPartFileExt(n string) {
+	std.SetPartFileExt(n)
+}
+
+// SetRemoteTime 设置下载完成后是否将文件的修改时间设置为远程资源的 Last-Modified
+func SetRemoteTime(n bool) {
+	std.SetRemoteTime(n)
+}
+
+// SetXattr 设置下载完成后是否记录文件的来源到扩展属性
+func SetXattr(n bool) {
+	std.SetXattr(n)
+}
+
+// SetAria2ControlFile 设置是否同时写入 aria2 格式的控制文件
+func SetAria2ControlFile(n bool) {
+	std.SetAria2ControlFile(n)
+}
+
 // Copy 在执行下载前，会拷贝 Down
 func Copy() *Down {
 	return std.Copy()
@@ -157,3 +250,8 @@ func Copy() *Down {
 func AddHook(perhook PerHook) {
 	std.AddHook(perhook)
 }
+
+// AddMiddleware 添加请求中间件，按添加的顺序调用
+func AddMiddleware(m ...RequestMiddleware) {
+	std.AddMiddleware(m...)
+}
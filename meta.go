@@ -1,31 +1,61 @@
 package down
 
 import (
+	"context"
 	"io"
 	"io/fs"
 	"net/http"
+	"time"
 )
 
 // Meta 下载信息，请求信息和存储信息
 type Meta struct {
 	// URI 下载资源的地址
 	URI string
+	// URLResolver 获取下载地址和请求头，用于会过期的签名地址，默认为 nil
+	// 设置后请求 URI 时使用获取到的地址，请求返回 401、403、410 或者超过 URLMaxAge 时重新获取
+	// URI 为空时使用第一次获取的地址作为 URI
+	URLResolver func(ctx context.Context) (string, http.Header, error)
+	// URLMaxAge URLResolver 获取的地址的有效时间，默认为 0 只在请求被拒绝时重新获取
+	URLMaxAge time.Duration
+	// Mirrors 镜像地址，多线程下载时不同的数据块同时从不同的地址下载
+	// 文件大小与 URI 一致且支持 range 请求的镜像才会使用，默认为空
+	Mirrors []string
 	// OutputName 输出文件名，为空则通过 getFileName 自动获取
 	OutputName string
 	// OutputDir 输出目录，默认为 ./
 	OutputDir string
 
-	// Method 默认为 GET
+	// Method 默认为 GET，探测请求、每个数据块的 range 请求和重试都使用此方法
 	Method string
 
 	// Body 请求时的 Body，默认为 nil
+	// 每个请求都需要发送完整的 Body，没有设置 GetBody 时下载前会读取到内存中
 	Body io.Reader
 
+	// GetBody 每次请求时创建新的 Body，设置后不再使用 Body，默认为 nil
+	GetBody func() (io.ReadCloser, error)
+
 	// Header 请求头，默认拷贝 defaultHeader
 	Header http.Header
 
+	// Middlewares 请求中间件，在 Down 的中间件之后按顺序调用，默认为空
+	Middlewares []RequestMiddleware
+
 	// Perm 新建文件的权限, 默认为 0600
 	Perm fs.FileMode
+
+	// BandwidthGroup 带宽组，与组内的其他下载共享限速，默认为 nil
+	BandwidthGroup *BandwidthGroup
+
+	// Checksum 下载完成后校验文件的哈希值，默认为 nil 不校验
+	Checksum *Checksum
+
+	// FileConflict 目标文件已存在时的处理方式，默认为 FileConflictDefault 使用 Down 的设置
+	FileConflict FileConflict
+
+	// ETag 使用没有控制文件的文件继续下载时，要求远程资源的 ETag 与此一致，默认为空不检查
+	ETag string
 }
 
 // defaultHeader 默认请求头
@@ -42,7 +72,7 @@ func NewMeta(uri, outputDir, outputName string) *Meta {
 	for k, v := range defaultHeader {
 		tmpVal := make([]string, len(v))
 		copy(tmpVal, v)
-		header[k] = v
+		header[k] = tmpVal
 	}
 
 	header.Set("referer", uri)
@@ -84,10 +114,25 @@ func (meta *Meta) Copy() *Meta {
 	for k, v := range meta.Header {
 		tmpVal := make([]string, len(v))
 		copy(tmpVal, v)
-		header[k] = v
+		header[k] = tmpVal
 	}
 
 	tmpMeta.Header = header
 
+	if meta.Checksum != nil {
+		checksum := *meta.Checksum
+		tmpMeta.Checksum = &checksum
+	}
+
+	if meta.Mirrors != nil {
+		tmpMeta.Mirrors = make([]string, len(meta.Mirrors))
+		copy(tmpMeta.Mirrors, meta.Mirrors)
+	}
+
+	if meta.Middlewares != nil {
+		tmpMeta.Middlewares = make([]RequestMiddleware, len(meta.Middlewares))
+		copy(tmpMeta.Middlewares, meta.Middlewares)
+	}
+
 	return &tmpMeta
 }
@@ -0,0 +1,32 @@
+package down
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// TestMetaHeaderCopy 测试复制的头信息不与原来的共用
+func TestMetaHeaderCopy(t *testing.T) {
+	meta := NewMeta("http://127.0.0.1/down.bin", "", "")
+	meta.Header["user-agent"][0] = "down"
+	if defaultHeader["user-agent"][0] == "down" {
+		t.Fatal("修改 Meta 的头信息时修改了默认头信息")
+	}
+
+	copied := meta.Copy()
+	copied.Header["user-agent"][0] = "copied"
+	if meta.Header["user-agent"][0] != "down" {
+		t.Fatal("修改复制的头信息时修改了原来的头信息")
+	}
+
+	od := &operatDown{meta: meta}
+	req, err := od.request(context.Background(), http.MethodGet, meta.URI, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header["user-agent"][0] = "request"
+	if meta.Header["user-agent"][0] != "down" {
+		t.Fatal("修改请求的头信息时修改了 Meta 的头信息")
+	}
+}
@@ -0,0 +1,33 @@
+package down
+
+import "net/http"
+
+// RequestMiddleware 请求中间件，每个请求发送前按顺序调用，包括探测请求和每个数据块的 range 请求
+// 可以添加认证头、签名请求或者改写请求地址，调用时 range 等请求头已经设置好
+// 请求失败重试时会重新创建请求并再次调用，过期的签名可以重新计算
+type RequestMiddleware interface {
+	Request(req *http.Request) error
+}
+
+// RequestMiddlewareFunc 将函数作为 RequestMiddleware 使用
+type RequestMiddlewareFunc func(req *http.Request) error
+
+// Request 调用函数本身
+func (f RequestMiddlewareFunc) Request(req *http.Request) error {
+	return f(req)
+}
+
+// middleware 先调用 Down 的中间件，再调用 Meta 的中间件，出错时返回错误不再发送请求
+func (od *operatDown) middleware(req *http.Request) error {
+	for _, m := range od.config.middlewares {
+		if err := m.Request(req); err != nil {
+			return err
+		}
+	}
+	for _, m := range od.meta.Middlewares {
+		if err := m.Request(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -22,8 +23,8 @@ type operation struct {
 	// hooks 通过 Down 的 PerHook 生成的 Hook
 	hooks []Hook
 
-	// filesize 文件总大小
-	filesize int64
+	// downloadSpeed 最近一次计算的每秒下载字节数
+	downloadSpeed int64
 
 	// ctx 上下文
 	ctx   context.Context
@@ -42,6 +43,79 @@ type Stat struct {
 	DownloadSpeed int64
 	// Connections 与资源服务器的连接数
 	Connections int
+	// Files 每个文件的下载状态，顺序与 Meta 一致
+	Files []*FileStat
+}
+
+// FileStat 单个文件的下载状态
+type FileStat struct {
+	Meta *Meta
+	// Outpath 文件输出位置
+	Outpath string
+	// TotalLength 文件大小
+	TotalLength int64
+	// CompletedLength 已下载的文件大小
+	CompletedLength int64
+	// Connections 与资源服务器的连接数
+	Connections int
+	// State 下载状态
+	State State
+	// Err 下载失败时的错误
+	Err error
+	// Blocks 数据块的下载进度
+	Blocks []BlockStat
+}
+
+// BlockStat 数据块的下载进度
+type BlockStat struct {
+	// Start 开始字节
+	Start int64
+	// End 结束字节
+	End int64
+	// Completed 已下载大小
+	Completed int64
+}
+
+// State 文件的下载状态
+type State int
+
+const (
+	// StateWaiting 等待下载
+	StateWaiting State = iota
+	// StateDownloading 下载中
+	StateDownloading
+	// StatePaused 已暂停
+	StatePaused
+	// StateFinished 下载完成
+	StateFinished
+	// StateError 下载失败
+	StateError
+	// StateSkipped 文件已存在，按 FileConflictSkip 跳过下载
+	StateSkipped
+)
+
+// String 状态名称
+func (s State) String() string {
+	switch s {
+	case StateWaiting:
+		return "waiting"
+	case StateDownloading:
+		return "downloading"
+	case StatePaused:
+		return "paused"
+	case StateFinished:
+		return "finished"
+	case StateError:
+		return "error"
+	case StateSkipped:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// MarshalText 以状态名称编码，方便输出 JSON
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
 }
 
 func newOperation(ctx context.Context, down *Down, meta []*Meta) *operation {
@@ -54,23 +128,30 @@ func newOperation(ctx context.Context, down *Down, meta []*Meta) *operation {
 		tmpod[i].config = down
 	}
 	operat.config = down
+	operat.meta = meta
 	operat.od = tmpod
 
-	if down.timeout != 0 {
-		operat.ctx, operat.close = context.WithTimeout(ctx, down.timeout)
-	} else {
-		operat.ctx, operat.close = context.WithCancel(ctx)
-	}
+	// 下载总超时时间由每个文件按下载中的时间计算，暂停期间不计入
+	operat.ctx, operat.close = context.WithCancel(ctx)
 
 	return operat
 }
 
 func (operat *operation) start() error {
-	err := operat.initOD(operat.ctx)
+	begin := time.Now()
+	ctx, cancel := operat.ctx, context.CancelFunc(func() {})
+	if operat.config.timeout != 0 {
+		ctx, cancel = context.WithTimeout(operat.ctx, operat.config.timeout)
+	}
+	err := operat.initOD(ctx)
+	cancel()
 	if err != nil {
 		return err
 	}
-	operat.filesize = operat.getTotalLength()
+	// 检查远程资源的时间计入超时时间
+	for _, v := range operat.od {
+		v.timeout = operat.config.timeout - time.Since(begin)
+	}
 	err = operat.makeHook()
 	if err != nil {
 		return err
@@ -105,7 +186,7 @@ func (operat *operation) finish(err error) {
 func (operat *operation) makeHook() error {
 	var err error
 	operat.hooks = make([]Hook, len(operat.config.perHooks))
-	stat := &Stat{Down: operat.config, Meta: operat.meta, TotalLength: operat.filesize}
+	stat := &Stat{Down: operat.config, Meta: operat.meta, TotalLength: operat.getTotalLength()}
 	for idx, perhook := range operat.config.perHooks {
 		operat.hooks[idx], err = perhook.Make(stat)
 		if err != nil {
@@ -120,7 +201,7 @@ func (operat *operation) finishHook(down error) error {
 	err := Hooks(operat.hooks).Finish(down, &Stat{
 		Meta:        operat.meta,
 		Down:        operat.config,
-		TotalLength: operat.filesize,
+		TotalLength: operat.getTotalLength(),
 	})
 
 	if err != nil {
@@ -151,7 +232,7 @@ func (operat *operation) getCompletedLength() int64 {
 func (operat *operation) getTotalLength() int64 {
 	tmp := int64(0)
 	for _, v := range operat.od {
-		tmp += v.filesize
+		tmp += v.totalLength()
 	}
 	return tmp
 }
@@ -165,6 +246,23 @@ func (operat *operation) getConnectCount() int {
 	return tmp
 }
 
+// stat 获取当前的下载状态
+func (operat *operation) stat() *Stat {
+	files := make([]*FileStat, len(operat.od))
+	for idx, v := range operat.od {
+		files[idx] = v.stat()
+	}
+	return &Stat{
+		Meta:            operat.meta,
+		Down:            operat.config,
+		TotalLength:     operat.getTotalLength(),
+		CompletedLength: operat.getCompletedLength(),
+		DownloadSpeed:   atomic.LoadInt64(&operat.downloadSpeed),
+		Connections:     operat.getConnectCount(),
+		Files:           files,
+	}
+}
+
 // getOutpath 获取输出路径
 func (operat *operation) getOutpath() []string {
 	tmp := make([]string, len(operat.od))
@@ -193,6 +291,49 @@ func (operat *operation) startOD(ctx context.Context) {
 	}
 }
 
+// pause 暂停所有文件的下载
+func (operat *operation) pause() {
+	var wg sync.WaitGroup
+	for _, v := range operat.od {
+		wg.Add(1)
+		go func(od *operatDown) {
+			defer wg.Done()
+			od.pause()
+		}(v)
+	}
+	wg.Wait()
+}
+
+// setSpeedLimit 修改下载中所有文件的限速
+func (operat *operation) setSpeedLimit(n int) {
+	operat.config.SetSpeedLimit(n)
+	for _, v := range operat.od {
+		v.operatFile.setSpeedLimit(n)
+	}
+}
+
+// setBandwidthGroup 将下载中的所有文件加入带宽组
+func (operat *operation) setBandwidthGroup(n *BandwidthGroup) {
+	for _, v := range operat.od {
+		v.operatFile.group.Store(n)
+	}
+}
+
+// setThreadCount 修改下载中所有文件的最大线程数
+func (operat *operation) setThreadCount(n int) {
+	operat.config.SetThreadCount(n)
+	for _, v := range operat.od {
+		v.setThreadCount(n)
+	}
+}
+
+// resume 恢复所有文件的下载
+func (operat *operation) resume() {
+	for _, v := range operat.od {
+		v.resumeRun()
+	}
+}
+
 // sendStat 下载资源途中对数据的处理和发送 Hook
 func (operat *operation) sendStat() {
 	oldCompletedLength := operat.getCompletedLength()
@@ -200,7 +341,6 @@ func (operat *operation) sendStat() {
 	for {
 		select {
 		case <-time.After(operat.config.sendTime):
-			connections := operat.getConnectCount()
 			completedLength := operat.getCompletedLength()
 			// 下载速度
 			differ := completedLength - oldCompletedLength
@@ -209,15 +349,8 @@ func (operat *operation) sendStat() {
 				downloadSpeed = int64(float64(completedLength-oldCompletedLength) * ratio)
 			}
 			oldCompletedLength = completedLength
-			stat := &Stat{
-				Meta:            operat.meta,
-				Down:            operat.config,
-				TotalLength:     operat.filesize,
-				CompletedLength: completedLength,
-				DownloadSpeed:   downloadSpeed,
-				Connections:     connections,
-			}
-			operat.sendHook(stat)
+			atomic.StoreInt64(&operat.downloadSpeed, downloadSpeed)
+			operat.sendHook(operat.stat())
 		case <-operat.ctx.Done():
 			return
 		}
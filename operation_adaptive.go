@@ -0,0 +1,132 @@
+package down
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// adaptiveInterval 自适应连接数的调整间隔
+	adaptiveInterval = time.Second * 2
+	// adaptiveStart 自适应连接数的初始连接数
+	adaptiveStart = 2
+	// adaptiveGain 增加连接后总速度至少要提升的比例
+	adaptiveGain = 1.1
+	// adaptiveCooldown 减少连接后，等待多少个调整间隔再尝试增加连接
+	adaptiveCooldown = 5
+)
+
+// adaptive 根据下载速度自动调整连接数
+// 从少量连接开始，每次增加一个连接，总速度仍在提升就继续增加，直到达到上限
+// 增加连接后总速度没有提升时撤回增加的连接，服务器返回 429/503 时连接数减半
+type adaptive struct {
+	// wgpool 线程池，通过线程数上限控制连接数
+	wgpool *WaitGroupPool
+
+	// cl 文件已下载的大小
+	cl *int64
+
+	// ceiling 连接数上限
+	ceiling int
+
+	// throttled 服务器是否返回了 429/503
+	throttled int32
+
+	// lastCompleted 上一次调整时已下载的大小
+	lastCompleted int64
+
+	// lastSpeed 上一次调整时的总速度
+	lastSpeed int64
+
+	// grown 上一次调整是否增加了连接
+	grown bool
+
+	// cooldown 剩余的冷却次数
+	cooldown int
+
+	mux sync.Mutex
+}
+
+// newAdaptive 创建自适应连接数，ceiling 为连接数上限
+func newAdaptive(wgpool *WaitGroupPool, cl *int64, ceiling int) *adaptive {
+	a := &adaptive{wgpool: wgpool, cl: cl}
+	wgpool.SetSize(1)
+	a.setCeiling(ceiling)
+	return a
+}
+
+// setCeiling 修改连接数上限
+func (a *adaptive) setCeiling(n int) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if n <= 0 {
+		n = math.MaxInt32
+	}
+	a.ceiling = n
+	size := a.wgpool.Size()
+	if start := minInt(adaptiveStart, n); size < start {
+		size = start
+	}
+	a.wgpool.SetSize(minInt(size, n))
+}
+
+// throttle 服务器返回 429/503，下次调整时减少连接
+func (a *adaptive) throttle() {
+	atomic.StoreInt32(&a.throttled, 1)
+}
+
+// run 定时调整连接数，ctx 关闭时退出
+func (a *adaptive) run(ctx context.Context) {
+	a.mux.Lock()
+	a.lastCompleted = atomic.LoadInt64(a.cl)
+	a.lastSpeed = 0
+	a.grown = false
+	a.mux.Unlock()
+	for {
+		select {
+		case <-time.After(adaptiveInterval):
+			a.adjust()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// adjust 根据这段时间内的总速度和每个连接的速度调整连接数
+func (a *adaptive) adjust() {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	completed := atomic.LoadInt64(a.cl)
+	speed := int64(float64(completed-a.lastCompleted) / adaptiveInterval.Seconds())
+	a.lastCompleted = completed
+
+	size := a.wgpool.Size()
+	connections := a.wgpool.Count()
+	switch {
+	case atomic.SwapInt32(&a.throttled, 0) == 1:
+		// 服务器限流
+		size /= 2
+		a.cooldown = adaptiveCooldown
+		a.grown = false
+	case a.grown && float64(speed) < float64(a.lastSpeed)*adaptiveGain:
+		// 增加的连接没有带来提升
+		size--
+		a.cooldown = adaptiveCooldown
+		a.grown = false
+	case a.cooldown > 0:
+		a.cooldown--
+		a.grown = false
+	case size < a.ceiling && connections >= size && speed/int64(connections) > 0:
+		// 所有连接都在下载数据时才尝试增加连接
+		size++
+		a.grown = true
+	default:
+		a.grown = false
+	}
+	a.lastSpeed = speed
+	a.wgpool.SetSize(maxInt(size, 1))
+}
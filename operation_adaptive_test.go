@@ -0,0 +1,44 @@
+package down
+
+import "testing"
+
+// TestAdaptiveAdjust 测试根据下载速度调整连接数
+func TestAdaptiveAdjust(t *testing.T) {
+	pool := NewWaitGroupPool(4)
+	cl := new(int64)
+	a := newAdaptive(pool, cl, 4)
+	if pool.Size() != adaptiveStart {
+		t.Fatalf("初始连接数为 %d, 应为 %d", pool.Size(), adaptiveStart)
+	}
+	pool.Add()
+	pool.Add()
+
+	step := func(completed int64, size int) {
+		t.Helper()
+		*cl += completed
+		a.adjust()
+		if pool.Size() != size {
+			t.Fatalf("连接数为 %d, 应为 %d", pool.Size(), size)
+		}
+	}
+
+	// 所有连接都在下载时增加连接
+	step(100<<20, 3)
+	pool.Add()
+	// 速度提升后继续增加
+	step(200<<20, 4)
+	pool.Add()
+	// 速度没有提升时撤回
+	step(200<<20, 3)
+	// 冷却中不增加连接
+	step(200<<20, 3)
+	// 服务器限流时连接数减半
+	a.throttle()
+	step(200<<20, 1)
+
+	// 连接数上限
+	a.setCeiling(1)
+	if pool.Size() != 1 {
+		t.Fatalf("连接数上限为 1 时连接数为 %d", pool.Size())
+	}
+}
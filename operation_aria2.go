@@ -0,0 +1,161 @@
+package down
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+/*
+aria2 控制文件（.aria2）的导入和导出，格式参考 aria2 文档 Control File 章节
+版本 1 为大端序，版本 0 为主机字节序，这里按小端序处理
+
+	VER(2) EXT(4) INFO_HASH_LENGTH(4) INFO_HASH PIECE_LENGTH(4) TOTAL_LENGTH(8) UPLOAD_LENGTH(8)
+	BITFIELD_LENGTH(4) BITFIELD NUM_IN_FLIGHT_PIECE(4)
+	IN_FLIGHT_PIECE: INDEX(4) LENGTH(4) PIECE_BITFIELD_LENGTH(4) PIECE_BITFIELD
+*/
+
+const (
+	// ARIA2FILEEXT aria2 控制文件后缀
+	ARIA2FILEEXT = "aria2"
+	// ARIA2PIECELENGTH 导出时使用的分片大小，与 aria2 默认的 --piece-length 一致
+	ARIA2PIECELENGTH = 1048576
+	// aria2BlockLength 分片内部每个小块的大小，正在下载的分片按小块记录进度
+	aria2BlockLength = 16384
+)
+
+// parseAria2Controlfile 解析 aria2 控制文件，将分片的 bitfield 转换为数据块
+// 连续完成的分片合并为一个已完成的数据块，连续未完成的分片合并为一个未完成的数据块
+// 转换后的版本为 0，续传前校验时会根据文件中已有的数据计算 CRC32
+func parseAria2Controlfile(data []byte) *controlfile {
+	if len(data) < 2 {
+		return nil
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	switch binary.BigEndian.Uint16(data[:2]) {
+	case 1:
+	case 0:
+		order = binary.LittleEndian
+	default:
+		return nil
+	}
+	r := bytes.NewReader(data[2:])
+	ok := true
+	read := func(v any) {
+		if ok && binary.Read(r, order, v) != nil {
+			ok = false
+		}
+	}
+	var (
+		ext, infoHashLength, pieceLength, bitfieldLength, numInFlight uint32
+		total, upload                                                 uint64
+	)
+	read(&ext)
+	read(&infoHashLength)
+	// 只支持 HTTP 下载，BitTorrent 下载的控制文件有 info hash
+	if !ok || infoHashLength != 0 {
+		return nil
+	}
+	read(&pieceLength)
+	read(&total)
+	read(&upload)
+	read(&bitfieldLength)
+	if !ok || pieceLength == 0 || total > 1<<62 {
+		return nil
+	}
+	numPieces := int64((total + uint64(pieceLength) - 1) / uint64(pieceLength))
+	if int64(bitfieldLength) != (numPieces+7)/8 || int(bitfieldLength) > r.Len() {
+		return nil
+	}
+	bitfield := make([]byte, bitfieldLength)
+	r.Read(bitfield)
+
+	// 正在下载的分片，只使用从分片开头连续完成的部分
+	read(&numInFlight)
+	inFlight := make(map[int64]int64)
+	for i := uint32(0); ok && i < numInFlight; i++ {
+		var index, length, pieceBitfieldLength uint32
+		read(&index)
+		read(&length)
+		read(&pieceBitfieldLength)
+		if !ok || int(pieceBitfieldLength) > r.Len() {
+			return nil
+		}
+		pieceBitfield := make([]byte, pieceBitfieldLength)
+		r.Read(pieceBitfield)
+		prefix := int64(0)
+		for b := int64(0); b < int64(pieceBitfieldLength)*8 && bitSet(pieceBitfield, b); b++ {
+			prefix += aria2BlockLength
+		}
+		inFlight[int64(index)] = minInt64(prefix, int64(length))
+	}
+	if !ok {
+		return nil
+	}
+
+	cf := newControlfile(0)
+	cf.varsion = 0
+	cf.total = int64(total)
+	pl := int64(pieceLength)
+	for i := int64(0); i < numPieces; {
+		done := bitSet(bitfield, i)
+		j := i + 1
+		for j < numPieces && bitSet(bitfield, j) == done {
+			j++
+		}
+		start, end := i*pl, minInt64(j*pl, cf.total)-1
+		completed := inFlight[i]
+		if done {
+			completed = end - start + 1
+		}
+		cf.threadblock = append(cf.threadblock, &threadblock{completed: minInt64(completed, end-start+1), start: start, end: end})
+		i = j
+	}
+	return cf
+}
+
+// encodingAria2 编码为 aria2 控制文件，只有数据完全下载的分片才会标记为完成
+func (cf *controlfile) encodingAria2(pieceLength int64) *bytes.Buffer {
+	numPieces := (cf.total + pieceLength - 1) / pieceLength
+	bitfield := make([]byte, (numPieces+7)/8)
+
+	// 合并所有已下载的部分，再标记被完全覆盖的分片
+	ranges := make([][2]int64, 0, len(cf.threadblock))
+	for _, block := range cf.threadblock {
+		if block.completed > 0 && block.end >= block.start {
+			ranges = append(ranges, [2]int64{block.start, block.start + block.completed})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:0]
+	for _, v := range ranges {
+		if n := len(merged); n > 0 && v[0] <= merged[n-1][1] {
+			merged[n-1][1] = maxInt64(merged[n-1][1], v[1])
+			continue
+		}
+		merged = append(merged, v)
+	}
+	for _, v := range merged {
+		for i := (v[0] + pieceLength - 1) / pieceLength; i < numPieces && minInt64((i+1)*pieceLength, cf.total) <= v[1]; i++ {
+			bitfield[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 38+len(bitfield)))
+	binaryWrite := binaryWriteFunc(buf, binary.BigEndian)
+	binaryWrite(uint16(1))
+	binaryWrite(uint32(0))
+	binaryWrite(uint32(0))
+	binaryWrite(uint32(pieceLength))
+	binaryWrite(uint64(cf.total))
+	binaryWrite(uint64(0))
+	binaryWrite(uint32(len(bitfield)))
+	binaryWrite(bitfield)
+	binaryWrite(uint32(0))
+	return buf
+}
+
+// bitSet bitfield 中第 i 位是否为 1，高位在前
+func bitSet(bitfield []byte, i int64) bool {
+	return bitfield[i/8]&(0x80>>(i%8)) != 0
+}
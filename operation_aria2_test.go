@@ -0,0 +1,46 @@
+package down
+
+import "testing"
+
+// TestAria2Controlfile 测试 aria2 控制文件的导出和导入
+func TestAria2Controlfile(t *testing.T) {
+	cf := newControlfile(0)
+	cf.total = 95
+	// 0-39 完成，40-59 完成 15 字节，60-94 完成
+	cf.threadblock = []*threadblock{
+		{completed: 40, start: 0, end: 39},
+		{completed: 15, start: 40, end: 59},
+		{completed: 35, start: 60, end: 94},
+	}
+
+	parsed := parseAria2Controlfile(cf.encodingAria2(10).Bytes())
+	if parsed == nil || parsed.total != 95 || parsed.varsion != 0 {
+		t.Fatalf("解析 aria2 控制文件失败 %+v", parsed)
+	}
+	// 分片大小为 10，40-49 已经完成，50-59 未完成
+	want := []threadblock{
+		{completed: 50, start: 0, end: 49},
+		{completed: 0, start: 50, end: 59},
+		{completed: 35, start: 60, end: 94},
+	}
+	if len(parsed.threadblock) != len(want) {
+		t.Fatalf("数据块数量为 %d, 应为 %d", len(parsed.threadblock), len(want))
+	}
+	for idx, block := range parsed.threadblock {
+		if *block != want[idx] {
+			t.Fatalf("数据块 %d 为 %+v, 应为 %+v", idx, *block, want[idx])
+		}
+	}
+
+	// 正在下载的分片使用从开头连续完成的部分
+	data := cf.encodingAria2(aria2BlockLength * 4).Bytes()
+	data = append(data[:len(data)-4], 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 95, 0, 0, 0, 1, 0xc0)
+	parsed = parseAria2Controlfile(data)
+	if parsed == nil || len(parsed.threadblock) != 1 || parsed.threadblock[0].completed != 95 {
+		t.Fatalf("解析正在下载的分片失败 %+v", parsed)
+	}
+
+	if parseAria2Controlfile(data[:20]) != nil {
+		t.Fatal("不完整的 aria2 控制文件应该解析失败")
+	}
+}
@@ -0,0 +1,137 @@
+package down
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// downloadBlock 下载单个数据块，从数据块已下载的位置继续
+// 有镜像地址时每次请求选择连接数最少的地址，镜像出错时换一个地址重新请求
+// 连接速度过低或者读取响应时出错时断开连接，从已下载的位置重新请求，连续 retryNumber 次没有进展时返回错误
+func (od *operatDown) downloadBlock(ctx context.Context, id int) error {
+	retryNum := 0
+	for {
+		_, _, before := od.operatFile.operatCF.blockRange(id)
+		src := od.sources.acquire()
+		begin := time.Now()
+		reqCtx, cancel := context.WithCancel(ctx)
+		stalled := od.watchLowSpeed(reqCtx, cancel, id)
+		err := od.downloadRange(reqCtx, src.uri, id)
+		cancel()
+		_, _, after := od.operatFile.operatCF.blockRange(id)
+		od.sources.release(src, after-before, time.Since(begin), err != nil && !contextDone(ctx))
+		if err == nil || contextDone(ctx) {
+			return err
+		}
+		if atomic.LoadInt32(stalled) == 1 {
+			err = fmt.Errorf(ErrorLowSpeed, src.uri, od.config.lowSpeedLimit, od.config.lowSpeedTime)
+		} else {
+			// 镜像出错时换一个地址，连续出错的镜像会被弃用
+			if !src.primary {
+				continue
+			}
+			var re *readError
+			if !errors.As(err, &re) {
+				return err
+			}
+		}
+		// 有进展时重新计算重试次数，速度过低断开时低速期间下载的部分不算进展
+		progress := after - before
+		if atomic.LoadInt32(stalled) == 1 {
+			progress -= int64(od.config.lowSpeedLimit) * int64(od.config.lowSpeedTime/time.Second)
+		}
+		if progress > 0 {
+			retryNum = 0
+		}
+		retryNum++
+		if retryNum >= od.config.retryNumber {
+			return err
+		}
+		select {
+		case <-time.After(od.config.retryTime):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// blockDone 数据块下载完成，按数据块刷入磁盘时立即保存控制文件
+func (od *operatDown) blockDone() {
+	if od.config.syncPolicy == SyncBlock && od.config.continuew {
+		od.operatFile.operatCF.save()
+	}
+}
+
+// downloadRange 从 uri 请求数据块未下载的部分并写入文件
+func (od *operatDown) downloadRange(ctx context.Context, uri string, id int) error {
+	start, end, completed := od.operatFile.operatCF.seekBlock(id)
+	if start+completed > end {
+		return nil
+	}
+	res, err := od.rangeDo(ctx, uri, start+completed, end)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// 没有返回 206 时说明 If-Range 不匹配，远程资源已经发生变化
+	if res.StatusCode != http.StatusPartialContent {
+		if uri == od.meta.URI {
+			return errRemoteChanged
+		}
+		return fmt.Errorf(ErrorRequestStatus, uri, res.StatusCode)
+	}
+	// 重新获取地址后远程资源的大小需要与探测时一致
+	if size := rangeSize(res); size > 0 && od.filesize > 0 && size != od.filesize {
+		if uri == od.meta.URI {
+			return errRemoteChanged
+		}
+		return fmt.Errorf(ErrorSizeMismatch, uri, size, od.filesize)
+	}
+	// 写入到文件
+	return od.operatFile.iocopy(ctx, res.Body, start+completed, id, int(end-start-completed+1))
+}
+
+// watchLowSpeed 监测连接速度，每秒读取的数据低于 lowSpeedLimit 持续 lowSpeedTime 时断开连接
+// 限速时每个连接的速度不会超过限速平均到每个连接的速度，限速的读取是分块放行的，每秒读取的数据会有波动
+// 阈值不超过平均速度的四分之一，避免限速的连接被反复断开
+// 返回的标记为 1 时表示连接因为速度过低被断开
+func (od *operatDown) watchLowSpeed(ctx context.Context, cancel context.CancelFunc, id int) *int32 {
+	stalled := new(int32)
+	if od.config.lowSpeedLimit <= 0 || od.config.lowSpeedTime <= 0 {
+		return stalled
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var (
+			last     = od.operatFile.operatCF.blockReceived(id)
+			lowSince = time.Now()
+		)
+		for {
+			select {
+			case <-ticker.C:
+				received := od.operatFile.operatCF.blockReceived(id)
+				threshold := od.config.lowSpeedLimit
+				if limit := od.operatFile.speedLimit(); limit > 0 {
+					threshold = minInt(threshold, limit/maxInt(od.wgpool.Count(), 1)/4)
+				}
+				if received-last >= int64(threshold) {
+					lowSince = time.Now()
+				}
+				last = received
+				if time.Since(lowSince) >= od.config.lowSpeedTime {
+					atomic.StoreInt32(stalled, 1)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stalled
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"os"
@@ -16,18 +19,63 @@ const (
 	CONTROLFILESIZE = 34
 	// THREADBLOCKSIZE 一个线程块的长度
 	THREADBLOCKSIZE = 24
+	// THREADBLOCKSIZEV1 版本 1 中一个线程块的长度，多了 4 字节的 CRC32
+	THREADBLOCKSIZEV1 = 28
+	// CONTROLFILEVERSION 当前写入的控制文件版本
+	CONTROLFILEVERSION = 3
 	// CONTROLFILEHEAD 控制文件头 100 111 119 110
 	CONTROLFILEHEAD = "down"
+	// MINSPLITSIZE 拆分数据块时剩余部分的最小长度，剩余不足两倍时不再拆分
+	MINSPLITSIZE = 1048576
+)
+
+// 版本 3 控制文件的字段标签，每个字段为 1 字节标签、2 字节长度加内容
+const (
+	fieldEnd uint8 = iota
+	fieldTotal
+	fieldETag
+	fieldLastModified
+	fieldURI
+	fieldOutputName
+	fieldThreadSize
+	fieldCreatedAt
+	fieldHeadersHash
 )
 
 // controlfile 控制文件，记录了断点下载所需要的信息
 type controlfile struct {
-	// varsion 2 字节 版本，当前版本只有 0（0x0000）
+	// varsion 2 字节 版本
+	// 0（0x0000）线程块只有 completed、start、end
+	// 1（0x0001）线程块增加已下载数据的 CRC32，续传时校验
+	// 2（0x0002）文件总长度之后增加 ETag 和 Last-Modified，各为 2 字节长度加内容
+	// 3（0x0003）版本之后为字段列表，以 fieldEnd 结束，之后是 4 字节的数据块数量和数据块，
+	//            文件末尾为之前所有内容的 CRC32，用来发现写入不完整的控制文件
 	varsion uint16
 
 	// total 8 字节 文件总长度
 	total int64
 
+	// etag 远程资源的 ETag，版本 2 增加
+	etag string
+
+	// lastModified 远程资源的 Last-Modified，版本 2 增加
+	lastModified string
+
+	// uri 下载地址，版本 3 增加
+	uri string
+
+	// outputName 输出文件名，版本 3 增加
+	outputName string
+
+	// threadSize 创建时每个数据块的大小，版本 3 增加
+	threadSize int64
+
+	// createdAt 创建时间，版本 3 增加
+	createdAt time.Time
+
+	// headersHash 请求头的 SHA-256，版本 3 增加
+	headersHash []byte
+
 	// threadblock 未完成的线程信息
 	threadblock []*threadblock
 }
@@ -40,6 +88,20 @@ type threadblock struct {
 	start int64
 	// end 8 字节 结束字节
 	end int64
+	// crc 4 字节 已下载数据的 CRC32，版本 1 增加
+	crc uint32
+
+	// received 已读取的大小，包括还在写缓冲区中的数据，不写入控制文件
+	received int64
+	// active 是否有线程正在下载，不写入控制文件
+	active bool
+	// failed 本次运行中是否下载失败，不写入控制文件
+	failed bool
+}
+
+// remaining 还未读取的大小
+func (block *threadblock) remaining() int64 {
+	return block.end - (block.start + block.received) + 1
 }
 
 // operatCF 操作控制文件
@@ -50,6 +112,16 @@ type operatCF struct {
 	cf     *controlfile
 	change bool
 	mux    sync.Mutex
+	// saveMux 防止同时写入控制文件
+	saveMux sync.Mutex
+	// aria2path aria2 控制文件位置，导入或者导出 aria2 控制文件时不为空，下载完成后删除
+	aria2path string
+	// exportAria2 保存时是否同时写入 aria2 控制文件
+	exportAria2 bool
+	// data 下载的文件，保存控制文件前按 syncPolicy 刷入磁盘
+	data *os.File
+	// syncPolicy 下载的文件刷入磁盘的策略
+	syncPolicy SyncPolicy
 }
 
 // newOperatCF 新建操控控制文件
@@ -93,11 +165,37 @@ func (ocf *operatCF) check(perm fs.FileMode) (bool, error) {
 	return true, nil
 }
 
-// addTreadblock 添加数据块
-func (ocf *operatCF) addTreadblock(completed, start, end int64) int {
-	if ocf.file == nil {
-		return 0
+// setPath 修改控制文件位置，关闭之前打开的控制文件
+func (ocf *operatCF) setPath(path string) {
+	ocf.close()
+	ocf.file = nil
+	ocf.path = path
+	ocf.aria2path = ""
+}
+
+// checkAria2 读取 aria2 的控制文件，无法解析时不删除，只是不进行断点续传
+// 可以解析时新建自己的控制文件，之后的进度记录在自己的控制文件中
+func (ocf *operatCF) checkAria2(path string, perm fs.FileMode) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	cf := parseAria2Controlfile(data)
+	if cf == nil {
+		return false, nil
 	}
+	err = ocf.open(perm)
+	if err != nil {
+		return false, err
+	}
+	ocf.cf = cf
+	ocf.aria2path = path
+	ocf.change = true
+	return true, nil
+}
+
+// addTreadblock 添加数据块，未开启断点续传时只记录在内存中
+func (ocf *operatCF) addTreadblock(completed, start, end int64) int {
 	ocf.mux.Lock()
 	defer ocf.mux.Unlock()
 	ocf.cf.threadblock = append(ocf.cf.threadblock, &threadblock{
@@ -109,48 +207,258 @@ func (ocf *operatCF) addTreadblock(completed, start, end int64) int {
 	return len(ocf.cf.threadblock) - 1
 }
 
-// addCompleted 添加数据块已完成的数据量
-func (ocf *operatCF) addCompleted(key int, completed int64) {
-	if ocf.file == nil {
-		return
+// addCompleted 添加数据块已写入文件的数据，同时更新数据块的 CRC32
+func (ocf *operatCF) addCompleted(key int, p []byte) {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	block := ocf.cf.threadblock[key]
+	block.completed += int64(len(p))
+	block.crc = crc32.Update(block.crc, crc32.IEEETable, p)
+	ocf.change = true
+}
+
+// verify 读取文件校验数据块已下载的部分，不一致的数据块重新下载，返回重新下载的数据块数量
+// 版本 0 的控制文件没有记录 CRC32，直接使用文件中的数据计算
+func (ocf *operatCF) verify(f io.ReaderAt) int {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	corrupt := 0
+	for _, block := range ocf.cf.threadblock {
+		if block.completed <= 0 {
+			continue
+		}
+		h := crc32.NewIEEE()
+		_, err := io.Copy(h, io.NewSectionReader(f, block.start, block.completed))
+		if err == nil && (ocf.cf.varsion == 0 || h.Sum32() == block.crc) {
+			block.crc = h.Sum32()
+			continue
+		}
+		block.completed = 0
+		block.received = 0
+		block.crc = 0
+		corrupt++
+	}
+	ocf.cf.varsion = CONTROLFILEVERSION
+	ocf.change = true
+	return corrupt
+}
+
+// setRemote 记录远程资源的文件大小、ETag 和 Last-Modified
+func (ocf *operatCF) setRemote(total int64, etag, lastModified string) {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	ocf.cf.total = total
+	ocf.cf.etag = etag
+	ocf.cf.lastModified = lastModified
+	ocf.change = true
+}
+
+// setInfo 记录下载地址、输出文件名、数据块大小和请求头的哈希，第一次记录时同时记录创建时间
+func (ocf *operatCF) setInfo(uri, outputName string, threadSize int64, headersHash []byte) {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	cf := ocf.cf
+	cf.uri = uri
+	cf.outputName = outputName
+	cf.threadSize = threadSize
+	cf.headersHash = headersHash
+	if cf.createdAt.IsZero() {
+		cf.createdAt = time.Now()
+	}
+	ocf.change = true
+}
+
+// nextBlock 分配下一个需要下载的数据块，返回数据块 ID
+// 优先分配未完成且没有线程下载的数据块，其次按 threadSize 分配文件中未分配的部分
+// 全部分配后拆分剩余最多的数据块，将后一半分配给空闲的线程
+func (ocf *operatCF) nextBlock(total, threadSize int64) (int, bool) {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	cf := ocf.cf
+	for id, block := range cf.threadblock {
+		if !block.active && !block.failed && block.completed < block.end-block.start+1 {
+			block.active = true
+			block.received = block.completed
+			return id, true
+		}
+	}
+
+	// 未分配的部分
+	if start := cf.allocatedLength(); start < total {
+		end := start + threadSize - 1
+		if end >= total {
+			end = total - 1
+		}
+		return ocf.appendBlock(start, end), true
+	}
+
+	// 拆分剩余最多的数据块
+	var largest *threadblock
+	for _, block := range cf.threadblock {
+		if block.active && !block.failed && (largest == nil || block.remaining() > largest.remaining()) {
+			largest = block
+		}
+	}
+	if largest == nil || largest.remaining() < MINSPLITSIZE*2 {
+		return 0, false
+	}
+	mid := largest.start + largest.received + largest.remaining()/2
+	id := ocf.appendBlock(mid, largest.end)
+	largest.end = mid - 1
+	return id, true
+}
+
+// appendBlock 添加一个正在下载的数据块，需要持有锁
+func (ocf *operatCF) appendBlock(start, end int64) int {
+	ocf.cf.threadblock = append(ocf.cf.threadblock, &threadblock{start: start, end: end, active: true})
+	ocf.change = true
+	return len(ocf.cf.threadblock) - 1
+}
+
+// blockRange 获取数据块的开始字节、结束字节和已下载大小
+func (ocf *operatCF) blockRange(key int) (start, end, completed int64) {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	block := ocf.cf.threadblock[key]
+	return block.start, block.end, block.completed
+}
+
+// seekBlock 重新请求数据块前，将已读取的位置重置到已下载的位置
+func (ocf *operatCF) seekBlock(key int) (start, end, completed int64) {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	block := ocf.cf.threadblock[key]
+	block.received = block.completed
+	return block.start, block.end, block.completed
+}
+
+// blockReceived 获取数据块已读取的大小
+func (ocf *operatCF) blockReceived(key int) int64 {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	return ocf.cf.threadblock[key].received
+}
+
+// receive 记录数据块读取的数据，返回属于该数据块的字节数和数据块是否已经读取完
+// 数据块被拆分后结束字节会变小，超出的部分由新的数据块下载
+func (ocf *operatCF) receive(key int, n int) (int, bool) {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	block := ocf.cf.threadblock[key]
+	// 文件大小未知
+	if block.end < block.start {
+		block.received += int64(n)
+		return n, false
+	}
+	remaining := block.remaining()
+	if int64(n) >= remaining {
+		block.received += remaining
+		return int(remaining), true
 	}
+	block.received += int64(n)
+	return n, false
+}
+
+// release 数据块的下载线程退出，失败的数据块本次运行中不再分配
+func (ocf *operatCF) release(key int, err error) {
 	ocf.mux.Lock()
 	defer ocf.mux.Unlock()
-	ocf.cf.threadblock[key].completed = completed
+	block := ocf.cf.threadblock[key]
+	block.active = false
+	block.failed = err != nil
+}
+
+// resetRuntime 重新运行前重置数据块的运行状态
+func (ocf *operatCF) resetRuntime() {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	for _, block := range ocf.cf.threadblock {
+		block.active = false
+		block.failed = false
+		block.received = block.completed
+	}
+}
+
+// blockStat 获取所有数据块的下载进度
+func (ocf *operatCF) blockStat() []BlockStat {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	blocks := make([]BlockStat, len(ocf.cf.threadblock))
+	for idx, v := range ocf.cf.threadblock {
+		blocks[idx] = BlockStat{Start: v.start, End: v.end, Completed: v.completed}
+	}
+	return blocks
+}
+
+// reset 清空所有数据块，重新下载时使用
+func (ocf *operatCF) reset() {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	ocf.cf.threadblock = ocf.cf.threadblock[:0]
+	ocf.cf.varsion = CONTROLFILEVERSION
 	ocf.change = true
 }
 
+// completedLength 获取已下载的数据长度
+func (ocf *operatCF) completedLength() int64 {
+	ocf.mux.Lock()
+	defer ocf.mux.Unlock()
+	return ocf.cf.completedLength()
+}
+
 // autoSave 自动保存控制文件
 func (ocf *operatCF) autoSave(d time.Duration) {
 	for {
 		select {
 		case <-time.After(d):
-			if ocf.change {
-				ocf.mux.Lock()
-				ocf.save()
-				ocf.change = false
-				ocf.mux.Unlock()
-			}
+			ocf.save()
 		case <-ocf.ctx.Done():
 			return
 		}
 	}
 }
 
-// save 保存控制文件
+// save 保存控制文件，没有变化时不写入
 func (ocf *operatCF) save() {
 	if ocf.file == nil {
 		return
 	}
-	// 防止系统崩溃导致的数据丢失，下载的文件需要强制刷入到磁盘
+	ocf.saveMux.Lock()
+	defer ocf.saveMux.Unlock()
+	ocf.mux.Lock()
+	if !ocf.change {
+		ocf.mux.Unlock()
+		return
+	}
+	buf := ocf.cf.encoding()
+	var aria2buf *bytes.Buffer
+	if ocf.exportAria2 {
+		aria2buf = ocf.cf.encodingAria2(ARIA2PIECELENGTH)
+	}
+	ocf.change = false
+	ocf.mux.Unlock()
+	// 防止系统崩溃导致的数据丢失，控制文件记录的进度是在刷入磁盘之前获取的，
+	// 其中的数据都已经写入文件，先将下载的文件刷入磁盘再写入控制文件，控制文件就不会记录还没有写入磁盘的数据
+	if ocf.syncPolicy != SyncNever && ocf.data != nil {
+		ocf.data.Sync()
+	}
+	if aria2buf != nil {
+		os.WriteFile(ocf.aria2path, aria2buf.Bytes(), 0644)
+	}
+	size := int64(buf.Len())
 	ocf.file.Seek(0, 0)
-	io.Copy(ocf.file, ocf.cf.encoding())
-	// ocf.operatFile.file.Sync()
-	ocf.file.Sync()
+	io.Copy(ocf.file, buf)
+	ocf.file.Truncate(size)
+	if ocf.syncPolicy != SyncNever {
+		ocf.file.Sync()
+	}
 }
 
-// remove 删除控制文件
+// remove 删除控制文件，包括导入或者导出的 aria2 控制文件
 func (ocf *operatCF) remove() {
+	if ocf.aria2path != "" {
+		os.Remove(ocf.aria2path)
+	}
 	if ocf.file != nil {
 		ocf.close()
 		os.Remove(ocf.path)
@@ -186,18 +494,51 @@ func (cf *controlfile) completedLength() int64 {
 	return count
 }
 
-// encoding 编码输出二进制
+// allocatedLength 已分配给数据块的长度，也就是下一个数据块的开始位置
+// 数据块拆分后顺序会打乱，所以取最大的结束字节
+func (cf *controlfile) allocatedLength() int64 {
+	length := int64(0)
+	for _, block := range cf.threadblock {
+		if block.end+1 > length {
+			length = block.end + 1
+		}
+	}
+	return length
+}
+
+// encoding 编码输出二进制，始终使用当前版本
 func (cf *controlfile) encoding() *bytes.Buffer {
-	buf := bytes.NewBuffer(make([]byte, 0, len(cf.threadblock)*THREADBLOCKSIZE+CONTROLFILESIZE))
+	buf := bytes.NewBuffer(make([]byte, 0, len(cf.threadblock)*THREADBLOCKSIZEV1+CONTROLFILESIZE))
 	binaryWrite := binaryWriteFunc(buf, binary.BigEndian)
 	binaryWrite([]byte(CONTROLFILEHEAD))
-	binaryWrite(cf.varsion)
-	binaryWrite(cf.total)
+	binaryWrite(uint16(CONTROLFILEVERSION))
+	writeField := func(tag uint8, value []byte) {
+		binaryWrite(tag)
+		binaryWrite(uint16(len(value)))
+		binaryWrite(value)
+	}
+	writeInt := func(tag uint8, value int64) {
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(value))
+		writeField(tag, data)
+	}
+	writeInt(fieldTotal, cf.total)
+	writeField(fieldETag, []byte(cf.etag))
+	writeField(fieldLastModified, []byte(cf.lastModified))
+	writeField(fieldURI, []byte(cf.uri))
+	writeField(fieldOutputName, []byte(cf.outputName))
+	writeInt(fieldThreadSize, cf.threadSize)
+	writeInt(fieldCreatedAt, cf.createdAt.UnixNano())
+	writeField(fieldHeadersHash, cf.headersHash)
+	binaryWrite(uint8(fieldEnd))
+	binaryWrite(uint32(len(cf.threadblock)))
 	for _, v := range cf.threadblock {
 		binaryWrite(v.completed)
 		binaryWrite(v.start)
 		binaryWrite(v.end)
+		binaryWrite(v.crc)
 	}
+	binaryWrite(crc32.ChecksumIEEE(buf.Bytes()))
 	return buf
 }
 
@@ -214,7 +555,7 @@ func newControlfile(size int) *controlfile {
 		threadblockTmp[i] = new(threadblock)
 	}
 	return &controlfile{
-		varsion:     0,
+		varsion:     CONTROLFILEVERSION,
 		total:       0,
 		threadblock: threadblockTmp,
 	}
@@ -222,20 +563,196 @@ func newControlfile(size int) *controlfile {
 
 // parseControlfile 解析控制文件
 func parseControlfile(data []byte) *controlfile {
+	if len(data) < 6 || string(data[:4]) != CONTROLFILEHEAD {
+		return nil
+	}
+	varsion := binary.BigEndian.Uint16(data[4:6])
+	if varsion == 3 {
+		return parseControlfileV3(data)
+	}
+	return parseControlfileV0(data)
+}
+
+// parseControlfileV3 解析版本 3 的控制文件，文件末尾的 CRC32 不一致时说明写入不完整
+func parseControlfileV3(data []byte) *controlfile {
+	dataLen := len(data)
+	if dataLen < 10 {
+		return nil
+	}
+	if crc32.ChecksumIEEE(data[:dataLen-4]) != binary.BigEndian.Uint32(data[dataLen-4:]) {
+		return nil
+	}
+	r := bytes.NewReader(data[6 : dataLen-4])
+	cf := newControlfile(0)
+	for {
+		var tag uint8
+		if binary.Read(r, binary.BigEndian, &tag) != nil {
+			return nil
+		}
+		if tag == fieldEnd {
+			break
+		}
+		value, ok := readShortString(r)
+		if !ok {
+			return nil
+		}
+		cf.setField(tag, []byte(value))
+	}
+	var count uint32
+	if binary.Read(r, binary.BigEndian, &count) != nil || int64(r.Len()) != int64(count)*THREADBLOCKSIZEV1 {
+		return nil
+	}
+	cf.threadblock = make([]*threadblock, count)
+	for i := range cf.threadblock {
+		block := new(threadblock)
+		binary.Read(r, binary.BigEndian, &block.completed)
+		binary.Read(r, binary.BigEndian, &block.start)
+		binary.Read(r, binary.BigEndian, &block.end)
+		binary.Read(r, binary.BigEndian, &block.crc)
+		cf.threadblock[i] = block
+	}
+	return cf
+}
+
+// setField 设置控制文件的字段，不认识的字段直接忽略，方便以后增加字段
+func (cf *controlfile) setField(tag uint8, value []byte) {
+	readInt := func() int64 {
+		if len(value) != 8 {
+			return 0
+		}
+		return int64(binary.BigEndian.Uint64(value))
+	}
+	switch tag {
+	case fieldTotal:
+		cf.total = readInt()
+	case fieldETag:
+		cf.etag = string(value)
+	case fieldLastModified:
+		cf.lastModified = string(value)
+	case fieldURI:
+		cf.uri = string(value)
+	case fieldOutputName:
+		cf.outputName = string(value)
+	case fieldThreadSize:
+		cf.threadSize = readInt()
+	case fieldCreatedAt:
+		cf.createdAt = time.Unix(0, readInt())
+	case fieldHeadersHash:
+		cf.headersHash = value
+	}
+}
+
+// parseControlfileV0 解析版本 0 到 2 的控制文件
+func parseControlfileV0(data []byte) *controlfile {
 	dataLen := len(data)
 	// 检查是否符合规范
-	if dataLen < CONTROLFILESIZE || string(data[:4]) != CONTROLFILEHEAD || (dataLen-14)%THREADBLOCKSIZE != 0 {
+	if dataLen < CONTROLFILESIZE || string(data[:4]) != CONTROLFILEHEAD {
+		return nil
+	}
+	varsion := binary.BigEndian.Uint16(data[4:6])
+	blockSize := THREADBLOCKSIZE
+	switch varsion {
+	case 0:
+	case 1, 2:
+		blockSize = THREADBLOCKSIZEV1
+	default:
 		return nil
 	}
-	cf := newControlfile((dataLen - 14) / THREADBLOCKSIZE)
-	binary.Read(bytes.NewReader(data[4:6]), binary.BigEndian, &cf.varsion)
-	binary.Read(bytes.NewReader(data[6:14]), binary.BigEndian, &cf.total)
-	b := 0
-	for i := 14; i < dataLen-14; i += THREADBLOCKSIZE {
-		binary.Read(bytes.NewReader(data[i:i+8]), binary.BigEndian, &cf.threadblock[b].completed)
-		binary.Read(bytes.NewReader(data[i+8:i+16]), binary.BigEndian, &cf.threadblock[b].start)
-		binary.Read(bytes.NewReader(data[i+16:i+24]), binary.BigEndian, &cf.threadblock[b].end)
-		b++
+	r := bytes.NewReader(data[6:])
+	var (
+		total        int64
+		etag         string
+		lastModified string
+		ok           = true
+	)
+	binary.Read(r, binary.BigEndian, &total)
+	if varsion >= 2 {
+		etag, ok = readShortString(r)
+		if ok {
+			lastModified, ok = readShortString(r)
+		}
+	}
+	if !ok || r.Len()%blockSize != 0 {
+		return nil
+	}
+	cf := newControlfile(r.Len() / blockSize)
+	cf.varsion = varsion
+	cf.total = total
+	cf.etag = etag
+	cf.lastModified = lastModified
+	for _, block := range cf.threadblock {
+		binary.Read(r, binary.BigEndian, &block.completed)
+		binary.Read(r, binary.BigEndian, &block.start)
+		binary.Read(r, binary.BigEndian, &block.end)
+		if varsion >= 1 {
+			binary.Read(r, binary.BigEndian, &block.crc)
+		}
 	}
 	return cf
 }
+
+// readShortString 读取 2 字节长度加内容的字符串
+func readShortString(r *bytes.Reader) (string, bool) {
+	var n uint16
+	if binary.Read(r, binary.BigEndian, &n) != nil || int(n) > r.Len() {
+		return "", false
+	}
+	buf := make([]byte, n)
+	r.Read(buf)
+	return string(buf), true
+}
+
+// ControlFileInfo 控制文件记录的信息，可以直接编码为 JSON
+type ControlFileInfo struct {
+	// Version 控制文件版本
+	Version uint16
+	// URI 下载地址，版本 3 之前为空
+	URI string
+	// OutputName 输出文件名，版本 3 之前为空
+	OutputName string
+	// ThreadSize 数据块大小，版本 3 之前为 0
+	ThreadSize int64
+	// CreatedAt 创建时间，版本 3 之前为零值
+	CreatedAt time.Time
+	// HeadersHash 请求头 SHA-256 的十六进制，版本 3 之前为空
+	HeadersHash string
+	// ETag 远程资源的 ETag
+	ETag string
+	// LastModified 远程资源的 Last-Modified
+	LastModified string
+	// TotalLength 文件大小
+	TotalLength int64
+	// CompletedLength 已下载的大小
+	CompletedLength int64
+	// Blocks 数据块的下载进度
+	Blocks []BlockStat
+}
+
+// InspectControlFile 读取控制文件，查看未完成的下载属于哪个文件以及下载进度
+func InspectControlFile(path string) (*ControlFileInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cf := parseControlfile(data)
+	if cf == nil {
+		return nil, fmt.Errorf(ErrorControlFile, path)
+	}
+	info := &ControlFileInfo{
+		Version:         cf.varsion,
+		URI:             cf.uri,
+		OutputName:      cf.outputName,
+		ThreadSize:      cf.threadSize,
+		CreatedAt:       cf.createdAt,
+		HeadersHash:     hex.EncodeToString(cf.headersHash),
+		ETag:            cf.etag,
+		LastModified:    cf.lastModified,
+		TotalLength:     cf.total,
+		CompletedLength: cf.completedLength(),
+		Blocks:          make([]BlockStat, len(cf.threadblock)),
+	}
+	for idx, v := range cf.threadblock {
+		info.Blocks[idx] = BlockStat{Start: v.start, End: v.end, Completed: v.completed}
+	}
+	return info, nil
+}
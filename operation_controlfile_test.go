@@ -0,0 +1,91 @@
+package down
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// TestOperatCFNextBlock 测试数据块分配和拆分
+func TestOperatCFNextBlock(t *testing.T) {
+	total := int64(MINSPLITSIZE * 8)
+	ocf := newOperatCF(context.Background(), "")
+	ocf.cf = newControlfile(0)
+
+	// 按 threadSize 分配
+	for i := 0; i < 2; i++ {
+		id, ok := ocf.nextBlock(total, total/2)
+		if !ok || id != i {
+			t.Fatalf("分配数据块失败, 获得 %d %v", id, ok)
+		}
+	}
+
+	// 全部分配后拆分剩余最多的数据块
+	ocf.receive(1, MINSPLITSIZE*2)
+	id, ok := ocf.nextBlock(total, total/2)
+	if !ok {
+		t.Fatal("拆分数据块失败")
+	}
+	start, end, _ := ocf.blockRange(id)
+	if start != MINSPLITSIZE*2 || end != MINSPLITSIZE*4-1 {
+		t.Fatalf("拆分后的数据块为 %d-%d, 应为 %d-%d", start, end, MINSPLITSIZE*2, MINSPLITSIZE*4-1)
+	}
+	if _, end, _ := ocf.blockRange(0); end != MINSPLITSIZE*2-1 {
+		t.Fatalf("被拆分的数据块结束字节为 %d, 应为 %d", end, MINSPLITSIZE*2-1)
+	}
+	if n := ocf.cf.allocatedLength(); n != total {
+		t.Fatalf("已分配长度为 %d, 应为 %d", n, total)
+	}
+
+	// 被拆分的数据块只接收到新的结束字节
+	n, done := ocf.receive(0, MINSPLITSIZE*3)
+	if n != MINSPLITSIZE*2 || !done {
+		t.Fatalf("接收数据 %d %v, 应为 %d true", n, done, MINSPLITSIZE*2)
+	}
+
+	// 剩余不足时不再拆分
+	ocf.addCompleted(0, make([]byte, MINSPLITSIZE*2))
+	ocf.release(0, nil)
+	ocf.receive(1, MINSPLITSIZE*2)
+	ocf.receive(2, MINSPLITSIZE)
+	if id, ok := ocf.nextBlock(total, total/2); ok {
+		t.Fatalf("剩余不足时不应该拆分, 获得数据块 %d", id)
+	}
+}
+
+// TestOperatCFVerify 测试控制文件编码和续传时校验数据块
+func TestOperatCFVerify(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	ocf := newOperatCF(context.Background(), "")
+	ocf.cf = newControlfile(0)
+	ocf.setRemote(int64(len(data)), `"etag"`, "Wed, 21 Oct 2015 07:28:00 GMT")
+	for i := 0; i < 2; i++ {
+		id := ocf.addTreadblock(0, int64(i*10), int64(i*10+9))
+		ocf.addCompleted(id, data[i*10:i*10+4])
+		ocf.addCompleted(id, data[i*10+4:i*10+8])
+	}
+
+	cf := parseControlfile(ocf.cf.encoding().Bytes())
+	if cf == nil || cf.varsion != CONTROLFILEVERSION || len(cf.threadblock) != 2 {
+		t.Fatalf("解析控制文件失败 %+v", cf)
+	}
+	if cf.total != ocf.cf.total || cf.etag != ocf.cf.etag || cf.lastModified != ocf.cf.lastModified {
+		t.Fatalf("解析控制文件的远程资源信息为 %d %s %s", cf.total, cf.etag, cf.lastModified)
+	}
+	for idx, block := range cf.threadblock {
+		if *block != *ocf.cf.threadblock[idx] {
+			t.Fatalf("数据块 %d 为 %+v, 应为 %+v", idx, block, ocf.cf.threadblock[idx])
+		}
+	}
+
+	// 第二个数据块写入磁盘的数据损坏
+	file := append([]byte{}, data...)
+	file[12] = 'x'
+	ocf.cf = cf
+	if n := ocf.verify(bytes.NewReader(file)); n != 1 {
+		t.Fatalf("损坏的数据块数量为 %d, 应为 1", n)
+	}
+	if ocf.cf.threadblock[0].completed != 8 || ocf.cf.threadblock[1].completed != 0 {
+		t.Fatalf("校验后已下载大小为 %d %d, 应为 8 0", ocf.cf.threadblock[0].completed, ocf.cf.threadblock[1].completed)
+	}
+}
@@ -1,8 +1,9 @@
 package down
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -30,6 +32,9 @@ type operatDown struct {
 	// wgpool 线程池
 	wgpool *WaitGroupPool
 
+	// adaptive 自适应连接数，未开启时为 nil
+	adaptive *adaptive
+
 	// multithread 是否使用多线程下载
 	multithread bool
 
@@ -39,6 +44,30 @@ type operatDown struct {
 	// filesize 文件大小
 	filesize int64
 
+	// etag 远程资源的 ETag
+	etag string
+
+	// lastModified 远程资源的 Last-Modified
+	lastModified string
+
+	// contentType 远程资源的 Content-Type
+	contentType string
+
+	// restarted 远程资源变化后重新下载的次数
+	restarted int
+
+	// sources 下载地址，包括主地址和可用的镜像地址
+	sources *sources
+
+	// body 没有设置 Meta.GetBody 时读取到内存中的 Meta.Body
+	body []byte
+
+	// resolver 设置了 Meta.URLResolver 时获取会过期的下载地址，请求 URI 时使用获取到的地址
+	resolver *urlResolver
+
+	// redownloaded 校验失败后是否已经重新下载过
+	redownloaded bool
+
 	// cl 已下载的大小
 	cl *int64
 
@@ -48,9 +77,15 @@ type operatDown struct {
 	// outpath 下载目标位置
 	outpath string
 
+	// partpath 下载中的临时文件位置，下载成功后重命名为 outpath，不使用临时文件时与 outpath 相同
+	partpath string
+
 	// ctlpath 控制文件位置
 	ctlpath string
 
+	// aria2path 导出的 aria2 控制文件位置，aria2 要求控制文件与数据文件同名，在 partpath 后加 .aria2
+	aria2path string
+
 	// operatFile 操作文件
 	operatFile *operatFile
 
@@ -61,6 +96,33 @@ type operatDown struct {
 
 	// close 关闭
 	close closeFunc
+
+	// runClose 关闭当前运行中的下载线程，暂停时使用
+	runClose closeFunc
+
+	// stopped 当前运行中的下载线程全部退出并保存进度后关闭
+	stopped chan struct{}
+
+	// resume 暂停中不为空，恢复下载时关闭
+	resume chan struct{}
+
+	// timeout 剩余的下载超时时间，只在下载中减少，Down 没有设置超时时间时不使用
+	timeout time.Duration
+
+	// skipped 目标文件已存在，跳过下载
+	skipped bool
+
+	// finished 是否已经下载结束
+	finished bool
+
+	// state 下载状态
+	state State
+
+	// multithRun 当前是否在多线程下载
+	multithRun bool
+
+	// mux 暂停、恢复和下载状态的锁
+	mux sync.Mutex
 }
 
 func (od *operatDown) init(ctx context.Context) error {
@@ -69,17 +131,14 @@ func (od *operatDown) init(ctx context.Context) error {
 	od.close = func() { cancel() }
 	// 请求配置
 	od.client = &http.Client{
-		Transport: &http.Transport{
-			// 应用来自环境变量的代理
-			Proxy: od.config.proxy,
-			// 要求服务器返回非压缩的内容，前提是没有发送 accept-encoding 来接管 transport 的自动处理
-			DisableCompression: true,
-			// 等待响应头的超时时间
-			ResponseHeaderTimeout: od.config.connectTimeout,
-			// TLS 握手超时时间
-			TLSHandshakeTimeout: 10 * time.Second,
-			// 接受服务器提供的任何证书
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		// 同一个 Down 的下载共享 Transport
+		Transport: od.config.roundTripper(),
+		// 重定向到其他 host 时同样检查公钥固定能否生效
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return od.config.checkPinHost(req.URL)
 		},
 		// 超时时间
 		Timeout: 0,
@@ -87,6 +146,31 @@ func (od *operatDown) init(ctx context.Context) error {
 	od.cl = new(int64)
 	od.done = make(chan error)
 	od.wgpool = NewWaitGroupPool(od.config.threadCount)
+	if od.config.adaptiveThread {
+		od.adaptive = newAdaptive(od.wgpool, od.cl, od.config.threadCount)
+	}
+	if od.meta.Method == "" {
+		od.meta.Method = http.MethodGet
+	}
+	// Body 需要在每个请求中发送，没有 GetBody 时读取到内存中
+	if od.meta.GetBody == nil && od.meta.Body != nil {
+		body, err := io.ReadAll(od.meta.Body)
+		if err != nil {
+			return err
+		}
+		od.body = body
+	}
+	// 下载地址会过期，URI 为空时使用第一次获取的地址
+	if od.meta.URLResolver != nil {
+		od.resolver = newURLResolver(od.meta.URLResolver, od.meta.URLMaxAge)
+		if od.meta.URI == "" {
+			uri, _, _, err := od.resolver.get(ctx)
+			if err != nil {
+				return err
+			}
+			od.meta.URI = uri
+		}
+	}
 
 	// 检查远程资源和本地文件
 	if err := od.check(ctx); err != nil {
@@ -101,46 +185,335 @@ func (od *operatDown) start(ctx context.Context) {
 }
 
 func (od *operatDown) electe(ctx context.Context) {
+	if od.skipped {
+		od.skip()
+		return
+	}
+
 	// 当开启断点续传时，自动保存控制文件
 	if od.config.continuew {
 		go od.operatFile.operatCF.autoSave(od.config.autoSaveTnterval)
 	}
 
-	// 单线程下载逻辑
-	if !od.multithread || od.config.threadCount <= 1 {
-		if od.breakpoint {
-			od.singleBreakpoint(ctx)
-		} else {
-			od.single(ctx)
+	for {
+		// 暂停中时等待恢复
+		if err := od.waitResume(ctx); err != nil {
+			od.finish(err)
+			return
 		}
-		return
+
+		// 超时时间只计算下载中的时间，暂停期间不计入
+		begin := time.Now()
+		limitCtx, limitCancel := ctx, context.CancelFunc(func() {})
+		if od.config.timeout != 0 {
+			limitCtx, limitCancel = context.WithTimeout(ctx, od.timeout)
+		}
+		runCtx, cancel := context.WithCancel(limitCtx)
+		stopped := make(chan struct{})
+		od.mux.Lock()
+		if od.resume != nil {
+			// 开始运行前被暂停
+			od.mux.Unlock()
+			cancel()
+			limitCancel()
+			continue
+		}
+		od.runClose = func() { cancel() }
+		od.stopped = stopped
+		od.state = StateDownloading
+		od.multithRun = od.multithread && od.wgpool.Size() > 1
+		multith := od.multithRun
+		od.mux.Unlock()
+
+		err := od.run(runCtx, multith)
+		cancel()
+
+		// 远程资源在下载中发生变化，重新获取文件信息后从头下载
+		restarted := false
+		if errors.Is(err, errRemoteChanged) && !contextDone(limitCtx) && od.restarted < od.config.retryNumber {
+			od.restarted++
+			err = od.restart(limitCtx)
+			restarted = err == nil
+		}
+
+		// 下载完成后校验文件，需要时重新下载
+		retried := false
+		if err == nil && !restarted {
+			err = od.verify()
+			retried = od.retryVerify(err)
+		}
+
+		ctxDone := contextDone(limitCtx)
+		limitCancel()
+		od.timeout -= time.Since(begin)
+		if restarted || retried {
+			close(stopped)
+			continue
+		}
+
+		od.mux.Lock()
+		paused := od.resume != nil
+		od.mux.Unlock()
+		if !paused || err == nil || ctxDone {
+			close(stopped)
+			od.finish(err)
+			return
+		}
+
+		// 暂停时保存进度，连接随 context 断开，空闲连接留在共享的连接池中
+		// 恢复后从数据块记录的位置继续
+		atomic.StoreInt64(od.cl, od.operatFile.operatCF.completedLength())
+		od.operatFile.operatCF.save()
+		close(stopped)
+	}
+}
+
+// run 根据是否支持多线程和断点续传选择下载逻辑
+func (od *operatDown) run(ctx context.Context, multith bool) error {
+	// 单线程下载逻辑，默认请求整个文件，支持 range 请求且已有下载进度时从数据块记录的位置继续
+	// 下载中增加线程数时从 single 已下载的位置切换为多线程
+	if !multith {
+		if od.multithread && od.operatFile.operatCF.completedLength() > 0 {
+			return od.singleBreakpoint(ctx)
+		}
+		return od.single(ctx)
 	}
 
 	// 多线程下载逻辑
-	if od.breakpoint {
-		od.multithBreakpoint(ctx)
+	return od.multith(ctx)
+}
+
+// setThreadCount 修改下载线程数
+// 单线程下载中增加线程数时，重新启动下载线程从已下载的位置切换为多线程下载
+func (od *operatDown) setThreadCount(n int) {
+	if od.adaptive != nil {
+		od.adaptive.setCeiling(n)
 	} else {
-		od.multith(ctx)
+		od.wgpool.SetSize(n)
+	}
+	od.mux.Lock()
+	restart := od.multithread && !od.multithRun && od.state == StateDownloading && od.wgpool.Size() > 1
+	od.mux.Unlock()
+	// 已经被暂停时不恢复
+	if restart && od.pause() {
+		od.resumeRun()
 	}
+}
+
+// pause 暂停下载，阻塞到所有下载线程退出并保存进度，返回是否由本次调用暂停
+func (od *operatDown) pause() bool {
+	od.mux.Lock()
+	if od.finished || od.resume != nil {
+		od.mux.Unlock()
+		return false
+	}
+	od.resume = make(chan struct{})
+	od.state = StatePaused
+	runClose, stopped := od.runClose, od.stopped
+	od.mux.Unlock()
 
+	if runClose != nil {
+		runClose()
+		<-stopped
+	}
+	return true
 }
 
-// finish 下载完成
+// resumeRun 恢复暂停的下载
+func (od *operatDown) resumeRun() {
+	od.mux.Lock()
+	defer od.mux.Unlock()
+	if od.resume != nil {
+		close(od.resume)
+		od.resume = nil
+		// 暂停期间被取消时已经下载结束
+		if !od.finished {
+			od.state = StateWaiting
+		}
+	}
+}
+
+// waitResume 暂停中时阻塞等待恢复
+func (od *operatDown) waitResume(ctx context.Context) error {
+	od.mux.Lock()
+	resume := od.resume
+	od.mux.Unlock()
+	if resume == nil {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// finish 下载完成，成功时将临时文件刷入磁盘并重命名为目标文件
 func (od *operatDown) finish(err error) {
 	// 保存控制文件
 	od.operatFile.operatCF.save()
 	// 释放资源
 	od.close()
+	if err == nil && od.partpath != od.outpath && od.config.syncPolicy != SyncNever {
+		err = od.operatFile.file.Sync()
+	}
 	od.operatFile.close()
-
-	od.err = err
+	if err == nil && od.partpath != od.outpath {
+		// 下载成功后再备份已存在的文件，失败时保留原来的文件
+		if od.fileConflict() == FileConflictBackup && fileExist(od.outpath) {
+			err = backupPath(od.outpath)
+		}
+		if err == nil {
+			err = os.Rename(od.partpath, od.outpath)
+		}
+	}
 	if err == nil {
+		err = od.setMetadata()
+	}
+	od.mux.Lock()
+	od.finished = true
+	od.err = err
+	if err != nil {
+		od.state = StateError
+	} else {
+		od.state = StateFinished
+	}
+	od.mux.Unlock()
+	var checksumErr *ChecksumError
+	if err == nil || errors.As(err, &checksumErr) {
 		// 删除控制文件
 		od.operatFile.operatCF.remove()
 	}
+	if checksumErr != nil && od.meta.Checksum.OnMismatch == ChecksumRemove {
+		os.Remove(od.partpath)
+	}
 	od.done <- err
 }
 
+// setMetadata 下载完成后按配置设置文件的修改时间和扩展属性
+// 扩展属性只在 Linux 上设置，文件系统不支持时忽略
+func (od *operatDown) setMetadata() error {
+	// 同步模式下次使用修改时间作为 If-Modified-Since，需要是远程资源的修改时间
+	sync := od.fileConflict() == FileConflictSync
+	if (od.config.remoteTime || sync) && od.lastModified != "" {
+		mtime, err := http.ParseTime(od.lastModified)
+		if err == nil {
+			err = os.Chtimes(od.outpath, mtime, mtime)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	attrs := make(map[string]string)
+	if od.config.xattr {
+		// 不记录签名地址中的访问凭证
+		if uri := originURL(od.meta.URI); uri != "" {
+			attrs["user.xdg.origin.url"] = uri
+		}
+		attrs["user.mime_type"] = od.contentType
+	}
+	// 同步模式记录远程资源的版本，下次下载时发送条件请求
+	if od.config.xattr || sync {
+		attrs["user.etag"] = od.etag
+		attrs["user.last_modified"] = od.lastModified
+	}
+	for name, value := range attrs {
+		if value != "" {
+			setXattr(od.outpath, name, value)
+		}
+	}
+	return nil
+}
+
+// skip 跳过下载
+func (od *operatDown) skip() {
+	od.close()
+	od.mux.Lock()
+	od.finished = true
+	od.state = StateSkipped
+	od.mux.Unlock()
+	od.done <- nil
+}
+
+// verify 校验文件的哈希值，单线程顺序下载时使用下载中计算的结果，否则重新读取文件
+func (od *operatDown) verify() error {
+	checksum := od.meta.Checksum
+	if checksum == nil {
+		return nil
+	}
+	sum, ok := od.operatFile.hasher.sum(od.filesize)
+	if !ok {
+		var err error
+		sum, err = fileHash(od.operatFile.file, checksum.Algorithm)
+		if err != nil {
+			return err
+		}
+	}
+	if !strings.EqualFold(sum, checksum.Value) {
+		return &ChecksumError{Path: od.partpath, Algorithm: checksum.Algorithm, Expected: checksum.Value, Actual: sum}
+	}
+	return nil
+}
+
+// retryVerify 校验失败时是否重新下载，只重新下载一次
+func (od *operatDown) retryVerify(err error) bool {
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) || od.meta.Checksum.OnMismatch != ChecksumRedownload || od.redownloaded {
+		return false
+	}
+	od.redownloaded = true
+	atomic.StoreInt64(od.cl, 0)
+	od.operatFile.operatCF.reset()
+	od.operatFile.hasher.reset()
+	return true
+}
+
+// restart 远程资源发生变化时重新获取文件信息，清空数据块从头下载
+func (od *operatDown) restart(ctx context.Context) error {
+	od.mux.Lock()
+	od.etag, od.lastModified = "", ""
+	od.mux.Unlock()
+	if err := od.checkMultith(ctx); err != nil {
+		return err
+	}
+	// 远程资源变化后镜像可能还是旧版本，重新检查
+	od.checkMirrors(ctx)
+	operatCF := od.operatFile.operatCF
+	operatCF.reset()
+	operatCF.setRemote(od.filesize, od.etag, od.lastModified)
+	operatCF.setInfo(od.meta.URI, od.filename, int64(od.config.threadSize), headerHash(od.meta.Header))
+	atomic.StoreInt64(od.cl, 0)
+	if od.operatFile.hasher != nil {
+		od.operatFile.hasher.reset()
+	}
+	return nil
+}
+
+// totalLength 获取文件总大小，重新下载时会变化
+func (od *operatDown) totalLength() int64 {
+	od.mux.Lock()
+	defer od.mux.Unlock()
+	return od.filesize
+}
+
+// stat 获取文件当前的下载状态
+func (od *operatDown) stat() *FileStat {
+	od.mux.Lock()
+	state, err, filesize := od.state, od.err, od.filesize
+	od.mux.Unlock()
+	return &FileStat{
+		Meta:            od.meta,
+		Outpath:         od.outpath,
+		TotalLength:     filesize,
+		CompletedLength: atomic.LoadInt64(od.cl),
+		Connections:     od.wgpool.Count(),
+		State:           state,
+		Err:             err,
+		Blocks:          od.operatFile.operatCF.blockStat(),
+	}
+}
+
 // wait 等待下载完成
 func (od *operatDown) wait() error {
 	return <-od.done
@@ -150,52 +523,105 @@ func (od *operatDown) wait() error {
 func (od *operatDown) check(ctx context.Context) error {
 	var err error
 
+	// 检查哈希算法
+	var hasher *seqHasher
+	if od.meta.Checksum != nil {
+		hasher, err = newSeqHasher(od.meta.Checksum.Algorithm)
+		if err != nil {
+			return err
+		}
+	}
+
 	// 检查是否可以使用多线程，顺便获取一些数据
 	err = od.checkMultith(ctx)
 	if err != nil {
 		return err
 	}
 
+	// 检查镜像地址
+	od.checkMirrors(ctx)
+
 	// 文件位置
 	od.outpath, err = filepath.Abs(filepath.Join(od.meta.OutputDir, od.filename))
 	if err != nil {
 		return err
 	}
-	od.ctlpath = fmt.Sprintf("%s.%s", od.outpath, od.config.tempFileExt)
+	od.setOutpath(od.outpath)
 
 	// 控制文件
 	operatCF := newOperatCF(ctx, od.ctlpath)
+	operatCF.syncPolicy = od.config.syncPolicy
 
 	// 文件检查
-	err = od.checkFile(operatCF)
+	err = od.checkFile(ctx, operatCF)
 	if err != nil {
 		return err
 	}
 
-	// 检查到不需要断点续传，新建控制文件
-	if !od.breakpoint && od.config.continuew {
-		err = operatCF.open(od.meta.Perm)
-		if err != nil {
-			return err
+	// 跳过下载时不创建文件
+	if od.skipped {
+		operatCF.close()
+		operatCF.cf = newControlfile(0)
+		od.operatFile = &operatFile{operatCF: operatCF, cl: od.cl, rate: NewLimiter(Inf, 0)}
+		return nil
+	}
+
+	// 检查到不需要断点续传，新建控制文件，未开启断点续传时只在内存中记录数据块
+	if !od.breakpoint {
+		if od.config.continuew {
+			err = operatCF.open(od.meta.Perm)
+			if err != nil {
+				return err
+			}
 		}
 		operatCF.cf = newControlfile(0)
-		operatCF.cf.total = od.filesize
+	}
+	operatCF.setRemote(od.filesize, od.etag, od.lastModified)
+	operatCF.setInfo(od.meta.URI, od.filename, int64(od.config.threadSize), headerHash(od.meta.Header))
+	// 同时写入 aria2 控制文件，方便切换到 aria2 继续下载
+	if od.config.aria2ControlFile && od.config.continuew {
+		operatCF.aria2path = od.aria2path
+		operatCF.exportAria2 = true
 	}
 
 	// 创建操作文件
-	od.operatFile, err = newOperatFile(ctx, operatCF, od.outpath, od.cl, od.config.diskCache, od.meta.Perm, od.config.speedLimit)
+	od.operatFile, err = newOperatFile(operatCF, od.partpath, od.cl, od.config.diskCache, od.meta.Perm, od.config.speedLimit, od.meta.BandwidthGroup, od.config.bandwidthGroup)
 	if err != nil {
 		return err
 	}
+	od.operatFile.hasher = hasher
 
 	return nil
 }
 
+// setOutpath 设置目标文件位置，同时设置临时文件和控制文件的位置
+func (od *operatDown) setOutpath(outpath string) {
+	od.outpath = outpath
+	od.ctlpath = fmt.Sprintf("%s.%s", outpath, od.config.tempFileExt)
+	od.partpath = outpath
+	if od.config.partFileExt != "" {
+		od.partpath = fmt.Sprintf("%s.%s", outpath, od.config.partFileExt)
+	}
+	od.aria2path = fmt.Sprintf("%s.%s", od.partpath, ARIA2FILEEXT)
+}
+
+// fileConflict 获取目标文件已存在时的处理方式，优先使用 Meta 的设置
+func (od *operatDown) fileConflict() FileConflict {
+	if od.meta.FileConflict != FileConflictDefault {
+		return od.meta.FileConflict
+	}
+	if od.config.fileConflict != FileConflictDefault {
+		return od.config.fileConflict
+	}
+	if od.config.allowOverwrite {
+		return FileConflictOverwrite
+	}
+	return FileConflictFail
+}
+
 // checkFile 文件检查
-func (od *operatDown) checkFile(operatCF *operatCF) error {
+func (od *operatDown) checkFile(ctx context.Context, operatCF *operatCF) error {
 	var err error
-	// 文件是否存在, 这里之后支持断点续传后需要改逻辑
-	outpathexist := fileExist(od.outpath)
 	ctlexist := fileExist(od.ctlpath)
 
 	// 目录不存在时创建目录
@@ -203,35 +629,221 @@ func (od *operatDown) checkFile(operatCF *operatCF) error {
 		os.MkdirAll(od.meta.OutputDir, os.ModePerm)
 	}
 
-	if od.multithread && outpathexist && od.config.continuew && ctlexist {
-		// 控制文件是否可以进行断点续传
-		ok, err := operatCF.check(od.meta.Perm)
+	// 已下载的数据，没有临时文件时可能是直接下载到目标位置的旧版本或者 aria2 等工具留下的文件
+	datapath := od.partpath
+	if !fileExist(datapath) {
+		datapath = od.outpath
+	}
+	dataexist := fileExist(datapath)
+	// aria2 的控制文件与数据文件同名
+	aria2path := fmt.Sprintf("%s.%s", datapath, ARIA2FILEEXT)
+	aria2exist := fileExist(aria2path)
+
+	if od.multithread && dataexist && od.config.continuew && (ctlexist || aria2exist) {
+		// 控制文件是否可以进行断点续传，没有控制文件时使用 aria2 的控制文件
+		var ok bool
+		if ctlexist {
+			ok, err = operatCF.check(od.meta.Perm)
+		} else {
+			ok, err = operatCF.checkAria2(aria2path, od.meta.Perm)
+		}
 		if err != nil {
 			return err
 		}
-		if ok && operatCF.cf.total == od.filesize {
+		// 文件大小、ETag 和 Last-Modified 都一致时才续传，防止拼接出新旧两个版本混合的文件
+		if ok && operatCF.cf.total == od.filesize && od.sameRemote(operatCF.cf) {
+			err = od.usePartFile(datapath)
+			if err != nil {
+				return err
+			}
+			// aria2 的控制文件跟随数据文件移动
+			if !ctlexist && aria2path != od.aria2path {
+				err = os.Rename(aria2path, od.aria2path)
+				if err != nil {
+					return err
+				}
+				operatCF.aria2path = od.aria2path
+			}
+			// 校验已下载的数据，系统崩溃时可能有记录为已下载但没有写入磁盘的数据
+			f, err := os.Open(od.partpath)
+			if err != nil {
+				return err
+			}
+			operatCF.verify(f)
+			f.Close()
 			atomic.SwapInt64(od.cl, operatCF.cf.completedLength())
 			od.breakpoint = true
 			return nil
 		}
 	}
 
-	if outpathexist && od.config.allowOverwrite {
-		// 允许删除文件重新下载
-		err = os.Remove(od.outpath)
+	// 没有控制文件时，将比远程资源小的文件当作已下载的开头部分继续下载
+	if od.multithread && dataexist && !ctlexist && !aria2exist && od.config.adoptPartial {
+		ok, err := od.adoptPartial(operatCF, datapath)
+		if err != nil || ok {
+			return err
+		}
+	}
+
+	// 不续传时删除之前留下的临时文件
+	if od.partpath != od.outpath && fileExist(od.partpath) {
+		err = os.Remove(od.partpath)
 		if err != nil {
 			return err
 		}
-	} else if outpathexist {
-		return fmt.Errorf(ErrorFileExist, od.outpath)
 	}
 
+	if !fileExist(od.outpath) {
+		return nil
+	}
+	return od.resolveConflict(ctx, operatCF)
+}
+
+// resolveConflict 按 fileConflict 处理已存在的目标文件
+func (od *operatDown) resolveConflict(ctx context.Context, operatCF *operatCF) error {
+	switch od.fileConflict() {
+	case FileConflictSync:
+		notModified, err := od.notModified(ctx)
+		if err != nil {
+			return err
+		}
+		if notModified {
+			od.skipped = true
+			return nil
+		}
+	case FileConflictFail:
+		return fmt.Errorf(ErrorFileExist, od.outpath)
+	case FileConflictSkip:
+		od.skipped = true
+		return nil
+	case FileConflictRename:
+		outpath, err := renamePath(od.outpath, func(path string) bool {
+			return fileExist(path) || fileExist(fmt.Sprintf("%s.%s", path, od.config.tempFileExt))
+		})
+		if err != nil {
+			return err
+		}
+		od.setOutpath(outpath)
+		// 之前打开的控制文件属于原来的文件
+		operatCF.setPath(od.ctlpath)
+		return nil
+	case FileConflictBackup:
+		// 使用临时文件下载时，下载成功后再备份
+		if od.partpath != od.outpath {
+			return nil
+		}
+		return backupPath(od.outpath)
+	}
+	// 覆盖时，使用临时文件下载完成后直接替换目标文件，否则删除文件重新下载
+	if od.partpath == od.outpath {
+		return os.Remove(od.outpath)
+	}
 	return nil
 }
 
+// notModified 发送条件请求检查已存在的文件是否是最新的
+// 有 Meta.ETag 或者上次下载记录的 ETag 时使用 If-None-Match
+// 否则使用上次下载记录的 Last-Modified 或者文件的修改时间作为 If-Modified-Since
+// 同时请求第一个字节，服务器不支持条件请求时不会返回整个文件
+func (od *operatDown) notModified(ctx context.Context) (bool, error) {
+	info, err := os.Stat(od.outpath)
+	if err != nil {
+		return false, err
+	}
+	if od.filesize > 0 && info.Size() != od.filesize {
+		return false, nil
+	}
+	res, err := od.defaultDo(ctx, od.meta.URI, func(req *http.Request) error {
+		req.Header.Set("range", "bytes=0-0")
+		etag := od.meta.ETag
+		if etag == "" {
+			etag, _ = getXattr(od.outpath, "user.etag")
+		}
+		lastModified, _ := getXattr(od.outpath, "user.last_modified")
+		switch {
+		case etag != "":
+			req.Header.Set("if-none-match", etag)
+		case lastModified != "":
+			req.Header.Set("if-modified-since", lastModified)
+		default:
+			req.Header.Set("if-modified-since", info.ModTime().UTC().Format(http.TimeFormat))
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusNotModified, nil
+}
+
+// usePartFile 将已下载的数据移动到临时文件位置
+func (od *operatDown) usePartFile(datapath string) error {
+	if datapath == od.partpath {
+		return nil
+	}
+	return os.Rename(datapath, od.partpath)
+}
+
+// adoptPartial 使用没有控制文件的文件继续下载，例如浏览器或者 curl -C - 留下的文件
+// 文件比远程资源小且 Meta.ETag 与远程资源一致时，添加一个已完成的数据块覆盖文件已有的部分
+func (od *operatDown) adoptPartial(operatCF *operatCF, datapath string) (bool, error) {
+	info, err := os.Stat(datapath)
+	if err != nil {
+		return false, err
+	}
+	size := info.Size()
+	if size == 0 || size >= od.filesize || (od.meta.ETag != "" && od.meta.ETag != od.etag) {
+		return false, nil
+	}
+	err = od.usePartFile(datapath)
+	if err != nil {
+		return false, err
+	}
+	if od.config.continuew {
+		err = operatCF.open(od.meta.Perm)
+		if err != nil {
+			return false, err
+		}
+	}
+	// 版本 0 的控制文件会在校验时根据文件中的数据计算 CRC32
+	operatCF.cf = newControlfile(0)
+	operatCF.cf.varsion = 0
+	operatCF.cf.total = od.filesize
+	operatCF.addTreadblock(size, 0, size-1)
+	f, err := os.Open(od.partpath)
+	if err != nil {
+		return false, err
+	}
+	operatCF.verify(f)
+	f.Close()
+	atomic.SwapInt64(od.cl, size)
+	od.breakpoint = true
+	return true, nil
+}
+
+// sameRemote 远程资源是否与控制文件记录的一致，控制文件没有记录时认为一致
+func (od *operatDown) sameRemote(cf *controlfile) bool {
+	if cf.etag != "" && cf.etag != od.etag {
+		return false
+	}
+	if cf.lastModified != "" && cf.lastModified != od.lastModified {
+		return false
+	}
+	return true
+}
+
+// ifRange 获取 If-Range 的值，优先使用强 ETag，弱 ETag 不能用于 If-Range
+func (od *operatDown) ifRange() string {
+	if od.etag != "" && !strings.HasPrefix(od.etag, "W/") {
+		return od.etag
+	}
+	return od.lastModified
+}
+
 // checkMultith 检查是否可以使用多线程，顺便获取一些数据
 func (od *operatDown) checkMultith(ctx context.Context) error {
-	res, err := od.rangeDo(ctx, 0, 9)
+	res, err := od.rangeDo(ctx, od.meta.URI, 0, 9)
 	if err != nil {
 		return err
 	}
@@ -244,24 +856,36 @@ func (od *operatDown) checkMultith(ctx context.Context) error {
 	acceptRanges := res.Header.Get("accept-ranges")
 	headinfo := []byte{}
 
-	// 获取文件总大小
+	// 获取文件总大小，Content-Range 没有总大小时为 0
+	filesize := int64(0)
 	rangeList := strings.Split(contentRange, "/")
 	if len(rangeList) > 1 {
-		od.filesize, _ = strconv.ParseInt(rangeList[1], 10, 64)
+		filesize, _ = strconv.ParseInt(rangeList[1], 10, 64)
 	}
 
-	// 是否可以使用多线程
-	if acceptRanges != "" || strings.Contains(contentRange, "bytes") || contentLength == "10" {
+	// 是否可以使用多线程，需要知道文件总大小
+	multithread := false
+	if filesize > 0 && acceptRanges != "none" && (acceptRanges != "" || strings.Contains(contentRange, "bytes") || contentLength == "10") {
 		headinfo, _ = io.ReadAll(res.Body)
-		od.multithread = true
-	} else {
-		// 不支持多线程重新获取文件总大小
-		if od.filesize == 0 {
-			od.filesize, _ = strconv.ParseInt(contentLength, 10, 64)
-		}
+		multithread = true
+	} else if filesize == 0 && res.StatusCode != http.StatusPartialContent {
+		// 不支持多线程重新获取文件总大小，206 的 Content-Length 不是文件总大小
+		filesize, _ = strconv.ParseInt(contentLength, 10, 64)
 	}
 
-	if od.meta.OutputName == "" {
+	// 记录远程资源的版本，续传和 range 请求时判断资源是否发生变化
+	// 重新下载时 stat 和 setThreadCount 会在其他 goroutine 中读取，需要加锁
+	od.mux.Lock()
+	od.etag = res.Header.Get("etag")
+	od.lastModified = res.Header.Get("last-modified")
+	od.contentType = contentType
+	od.filesize = filesize
+	od.multithread = multithread
+	od.mux.Unlock()
+
+	if od.filename != "" {
+		// 重新检查时不修改文件名称
+	} else if od.meta.OutputName == "" {
 		// 自动获取文件名称
 		od.filename = getFileName(od.meta.URI, contentDisposition, contentType, headinfo)
 	} else {
@@ -272,9 +896,14 @@ func (od *operatDown) checkMultith(ctx context.Context) error {
 }
 
 // rangeDo 基于 range 的请求
-func (od *operatDown) rangeDo(ctx context.Context, start, end int64) (*http.Response, error) {
-	res, err := od.defaultDo(ctx, func(req *http.Request) error {
+// 请求主地址时带上 If-Range，资源发生变化时服务器会返回完整的内容而不是 206
+// 镜像的 ETag 和 Last-Modified 通常与主地址不同，所以只对主地址使用
+func (od *operatDown) rangeDo(ctx context.Context, uri string, start, end int64) (*http.Response, error) {
+	res, err := od.defaultDo(ctx, uri, func(req *http.Request) error {
 		req.Header.Set("range", fmt.Sprintf("bytes=%d-%d", start, end))
+		if ifRange := od.ifRange(); ifRange != "" && uri == od.meta.URI {
+			req.Header.Set("if-range", ifRange)
+		}
 		return nil
 	})
 	if err != nil {
@@ -283,23 +912,58 @@ func (od *operatDown) rangeDo(ctx context.Context, start, end int64) (*http.Resp
 	return res, nil
 }
 
-// defaultDo 基于默认参数的请求
-func (od *operatDown) defaultDo(ctx context.Context, call func(req *http.Request) error) (*http.Response, error) {
-	req, err := od.request(ctx, http.MethodGet, od.meta.URI, od.meta.Body)
-	if err != nil {
-		return nil, err
-	}
-	if call != nil {
-		err = call(req)
+// defaultDo 基于默认参数的请求，每次重试都重新创建请求并调用中间件
+// 请求 URI 且设置了 Meta.URLResolver 时使用获取到的地址和请求头，地址过期时重新获取
+func (od *operatDown) defaultDo(ctx context.Context, uri string, call func(req *http.Request) error) (*http.Response, error) {
+	var (
+		gen      int
+		resolved = od.resolver != nil && uri == od.meta.URI
+	)
+	return od.do(func() (*http.Request, error) {
+		target, header := uri, http.Header(nil)
+		if resolved {
+			var err error
+			target, header, gen, err = od.resolver.get(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		body, err := od.newBody()
+		if err != nil {
+			return nil, err
+		}
+		req, err := od.request(ctx, od.meta.Method, target, body)
 		if err != nil {
 			return nil, err
 		}
+		for k, v := range header {
+			req.Header[k] = append([]string(nil), v...)
+		}
+		if call != nil {
+			err = call(req)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = od.middleware(req)
+		if err != nil {
+			return nil, err
+		}
+		return req, nil
+	}, func(code int) bool {
+		return resolved && od.resolver.expire(gen, code)
+	})
+}
+
+// newBody 创建请求的 Body，每个请求都发送完整的 Body
+func (od *operatDown) newBody() (io.Reader, error) {
+	if od.meta.GetBody != nil {
+		return od.meta.GetBody()
 	}
-	res, err := od.do(req)
-	if err != nil {
-		return res, err
+	if od.body != nil {
+		return bytes.NewReader(od.body), nil
 	}
-	return res, nil
+	return nil, nil
 }
 
 // request 对于 http.NewRequestWithContext 的包装
@@ -314,32 +978,61 @@ func (od *operatDown) request(ctx context.Context, method string, url string, bo
 	for k, v := range od.meta.Header {
 		tmpVal := make([]string, len(v))
 		copy(tmpVal, v)
-		header[k] = v
+		header[k] = tmpVal
 	}
 
 	req.Header = header
+	// 重定向时重新创建 Body
+	if od.meta.GetBody != nil {
+		req.GetBody = od.meta.GetBody
+	}
 
 	return req, nil
 }
 
 // do 对于 client.Do 的包装，主要实现重试机制
-func (od *operatDown) do(rsequest *http.Request) (*http.Response, error) {
+// newRequest 在每次请求前创建新的请求，创建失败时不再重试
+// expired 返回 true 时表示地址已过期，重新获取地址后的第一次请求不计入重试次数
+func (od *operatDown) do(newRequest func() (*http.Request, error), expired func(code int) bool) (*http.Response, error) {
 	// 请求失败时，重试机制
 	var (
 		res          *http.Response
 		requestError error
 		retryNum     = 0
+		refreshed    = false
 	)
 	for ; ; retryNum++ {
+		rsequest, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		// 无法检查公钥固定时不发送请求
+		if err := od.config.checkPinHost(rsequest.URL); err != nil {
+			return nil, err
+		}
 		res, requestError = od.client.Do(rsequest)
 		if requestError == nil && res.StatusCode < 400 {
 			break
-		} else if retryNum+1 >= od.config.retryNumber {
+		}
+		if requestError == nil {
+			res.Body.Close()
+			// 地址过期时重新获取地址后立即重试
+			if expired(res.StatusCode) && !refreshed {
+				refreshed = true
+				retryNum--
+				continue
+			}
+			// 服务器限流时减少连接数
+			if od.adaptive != nil && (res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable) {
+				od.adaptive.throttle()
+			}
+		}
+		if retryNum+1 >= od.config.retryNumber {
 			var err error
 			if requestError != nil {
 				err = requestError
 			} else {
-				err = fmt.Errorf(ErrorRequestStatus, od.meta.URI, res.StatusCode)
+				err = fmt.Errorf(ErrorRequestStatus, rsequest.URL, res.StatusCode)
 			}
 			return nil, err
 		}
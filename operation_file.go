@@ -27,27 +27,44 @@ type operatFile struct {
 	// cl 文件总体下载进度
 	cl *int64
 
-	// rate 限速器
+	// rate 限速器，不限速时为 Inf
 	rate *Limiter
 
-	// speedLimit
-	speedLimit int
+	// groups 创建时指定的带宽组，来自 Meta 和 Down
+	groups []*BandwidthGroup
 
-	// ctx 上下文
-	ctx context.Context
+	// group 下载中通过 Operation 设置的带宽组
+	group atomic.Pointer[BandwidthGroup]
+
+	// hasher 边下载边计算哈希，不需要校验时为 nil
+	hasher *seqHasher
 }
 
 // newOperatFile 创建操作文件
-func newOperatFile(ctx context.Context, operatCF *operatCF, outpath string, cl *int64, bufsize int, perm fs.FileMode, speedLimit int) (*operatFile, error) {
+func newOperatFile(operatCF *operatCF, outpath string, cl *int64, bufsize int, perm fs.FileMode, speedLimit int, groups ...*BandwidthGroup) (*operatFile, error) {
 	f, err := os.OpenFile(outpath, os.O_CREATE|os.O_RDWR, perm)
 	if err != nil {
 		return nil, err
 	}
-	var rate *Limiter
-	if speedLimit != 0 {
-		rate = NewLimiter(Limit(speedLimit), speedLimit)
+	operatCF.data = f
+	of := &operatFile{file: f, bufsize: bufsize, cl: cl, operatCF: operatCF, rate: NewLimiter(Inf, 0)}
+	for _, group := range groups {
+		if group != nil {
+			of.groups = append(of.groups, group)
+		}
+	}
+	of.setSpeedLimit(speedLimit)
+	return of, nil
+}
+
+// setSpeedLimit 修改限速，下载中也可以修改，n 为 0 时不限速
+func (of *operatFile) setSpeedLimit(n int) {
+	if n <= 0 {
+		of.rate.SetLimit(Inf)
+		return
 	}
-	return &operatFile{ctx: ctx, file: f, bufsize: bufsize, cl: cl, operatCF: operatCF, speedLimit: speedLimit, rate: rate}, nil
+	of.rate.SetBurst(n)
+	of.rate.SetLimit(Limit(n))
 }
 
 // makeFileAt 创建文件位置的操作文件
@@ -55,8 +72,8 @@ func (of *operatFile) makeFileAt(id int, start int64) *operatFileAt {
 	return &operatFileAt{id: id, of: of, start: start}
 }
 
-// iocopy 数据拷贝
-func (of *operatFile) iocopy(src io.Reader, start int64, blockid, dataSize int) error {
+// iocopy 数据拷贝，ctx 关闭时会中断限速等待
+func (of *operatFile) iocopy(ctx context.Context, src io.Reader, start int64, blockid, dataSize int) error {
 	// 硬盘缓冲区大小
 	writeBufsize := of.bufsize
 	if writeBufsize > dataSize {
@@ -68,7 +85,6 @@ func (of *operatFile) iocopy(src io.Reader, start int64, blockid, dataSize int)
 	var (
 		err     error
 		written int64
-		readbuf []byte
 	)
 
 	// 读缓冲大小
@@ -76,22 +92,14 @@ func (of *operatFile) iocopy(src io.Reader, start int64, blockid, dataSize int)
 	if defRadesize > dataSize {
 		defRadesize = dataSize
 	}
-	// 限速下载时的读缓冲大小
-	if of.rate != nil && of.speedLimit < defRadesize {
-		readbuf = make([]byte, of.speedLimit)
-	} else {
-		readbuf = make([]byte, defRadesize)
-	}
+	readbuf := make([]byte, defRadesize)
 
 	for {
-		var (
-			nr int
-			er error
-		)
-		if of.rate == nil {
-			nr, er = src.Read(readbuf)
-		} else {
-			nr, er = of.rateRead(src, readbuf)
+		nr, er := of.rateRead(ctx, src, readbuf)
+		// 只写入属于数据块的部分，数据块读取完后结束
+		done := false
+		if nr > 0 {
+			nr, done = of.operatCF.receive(blockid, nr)
 		}
 		if nr > 0 {
 			nw, ew := dst.Write(readbuf[0:nr])
@@ -102,6 +110,9 @@ func (of *operatFile) iocopy(src io.Reader, start int64, blockid, dataSize int)
 				}
 			}
 			of.addcl(nw)
+			if of.hasher != nil {
+				of.hasher.write(start+written, readbuf[:nw])
+			}
 			written += int64(nw)
 			if ew != nil {
 				err = ew
@@ -112,35 +123,93 @@ func (of *operatFile) iocopy(src io.Reader, start int64, blockid, dataSize int)
 				break
 			}
 		}
+		if done {
+			break
+		}
 		if er != nil {
 			if er != io.EOF {
-				err = er
+				err = &readError{err: er}
 			}
 			break
 		}
 	}
+	// 将写缓冲区的内容写入到文件，中途出错时也保留已读取的数据，以便暂停或续传时从这里继续
+	ew := dst.Flush()
 	if err != nil {
 		return err
 	}
-	// 写入完毕，将写缓冲区的内容写入到文件
-	err = dst.Flush()
-	if err != nil {
-		return err
+	return ew
+}
+
+// speedLimit 文件自身的限速和所有带宽组的限速中最低的，不限速时为 0
+func (of *operatFile) speedLimit() int {
+	n := 0
+	if limit := of.rate.Limit(); limit != Inf {
+		n = int(limit)
 	}
-	return nil
+	for _, group := range of.bandwidthGroups() {
+		if limit := group.Limit(); limit > 0 && (n == 0 || limit < n) {
+			n = limit
+		}
+	}
+	return n
 }
 
-// rateRead 限速读取
-func (of *operatFile) rateRead(src io.Reader, buf []byte) (n int, err error) {
-	n, err = src.Read(buf)
+// rateRead 限速读取，需要同时满足文件自身的限速和所有带宽组的限速
+func (of *operatFile) rateRead(ctx context.Context, src io.Reader, buf []byte) (n int, err error) {
+	limiters, size := of.limiters(len(buf))
+	if len(limiters) == 0 {
+		return src.Read(buf)
+	}
+	n, err = src.Read(buf[:size])
 	if err != nil {
 		return
 	}
-	err = of.rate.WaitN(of.ctx, n)
-
+	for _, rate := range limiters {
+		err = rate.WaitN(ctx, n)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
+// limiters 获取需要等待的限速器，以及每次读取的最大字节数
+func (of *operatFile) limiters(size int) ([]*Limiter, int) {
+	var limiters []*Limiter
+	if of.rate.Limit() != Inf {
+		limiters = append(limiters, of.rate)
+		if burst := of.rate.Burst(); burst < size {
+			size = burst
+		}
+	}
+	for _, group := range of.bandwidthGroups() {
+		quantum := group.quantum()
+		if quantum == 0 {
+			continue
+		}
+		limiters = append(limiters, group.rate)
+		if quantum < size {
+			size = quantum
+		}
+	}
+	return limiters, size
+}
+
+// bandwidthGroups 获取文件所属的带宽组，同一个带宽组只返回一次
+func (of *operatFile) bandwidthGroups() []*BandwidthGroup {
+	group := of.group.Load()
+	if group == nil {
+		return of.groups
+	}
+	for _, v := range of.groups {
+		if v == group {
+			return of.groups
+		}
+	}
+	return append(of.groups[:len(of.groups):len(of.groups)], group)
+}
+
 // addcl 新增进度
 func (of *operatFile) addcl(n int) {
 	atomic.AddInt64(of.cl, int64(n))
@@ -154,6 +223,19 @@ func (of *operatFile) close() {
 	}
 }
 
+// readError 读取响应时出现的错误，可以从已下载的位置重新请求
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+func (e *readError) Unwrap() error {
+	return e.err
+}
+
 // operatFileAt 指定位置
 type operatFileAt struct {
 	// of 下载文件控制
@@ -175,6 +257,6 @@ func (ofat *operatFileAt) Write(p []byte) (n int, err error) {
 
 	ofat.start += int64(n)
 	// 更新操作文件
-	ofat.of.operatCF.addCompleted(ofat.id, int64(n))
+	ofat.of.operatCF.addCompleted(ofat.id, p[:n])
 	return
 }
@@ -2,105 +2,64 @@ package down
 
 import "context"
 
-// multith 多线程下载
-func (od *operatDown) multith(ctx context.Context) {
+// multith 多线程下载，断点续传时从数据块记录的位置继续
+func (od *operatDown) multith(ctx context.Context) error {
 	if err := od.operatFile.file.Truncate(od.filesize); err != nil {
-		od.finish(err)
-		return
+		return err
+	}
+	od.operatFile.operatCF.resetRuntime()
+	// 根据下载速度自动调整连接数
+	if od.adaptive != nil {
+		go od.adaptive.run(ctx)
 	}
-	task := threadTaskSplit(0, od.filesize, int64(od.config.threadSize))
 	// 执行多线程任务
-	go od.startMultith(ctx, task)
+	go od.startMultith(ctx)
 	// 阻塞等待所有线程完成后返回结果
+	return od.waitMultith()
+}
+
+// waitMultith 阻塞等待所有线程完成后返回结果
+func (od *operatDown) waitMultith() error {
 	var tmperr error
 	for err := range od.wgpool.AllDone() {
 		if err != nil {
 			tmperr = err
 		} else {
-			od.finish(tmperr)
-			return
+			return tmperr
 		}
 	}
+	return tmperr
 }
 
-// startMultith 执行多线程
-func (od *operatDown) startMultith(ctx context.Context, task [][2]int64) {
-	for idx, fileRange := range task {
+// startMultith 执行多线程，每当有空闲的线程就分配一个数据块
+// 文件全部分配后，空闲的线程会拆分剩余最多的数据块，避免慢速连接拖慢整个下载
+func (od *operatDown) startMultith(ctx context.Context) {
+	for {
 		od.wgpool.Add()
+		// 中途关闭
 		if contextDone(ctx) {
 			od.wgpool.Done()
 			break
 		}
-		od.operatFile.operatCF.addTreadblock(0, fileRange[0], fileRange[1])
-		go od.multithSingle(ctx, idx, fileRange[0], fileRange[1], 0)
+		id, ok := od.operatFile.operatCF.nextBlock(od.filesize, int64(od.config.threadSize))
+		if !ok {
+			od.wgpool.Done()
+			break
+		}
+		go od.multithSingle(ctx, id)
 	}
 	// 非阻塞等待所有任务完成
 	od.wgpool.Syne()
 }
 
 // multithSingle 多线程下载中单个线程的下载逻辑
-func (od *operatDown) multithSingle(ctx context.Context, id int, start, end, completed int64) {
+func (od *operatDown) multithSingle(ctx context.Context, id int) {
 	defer od.wgpool.Done()
-	res, err := od.rangeDo(ctx, start, end)
+	err := od.downloadBlock(ctx, id)
+	od.operatFile.operatCF.release(id, err)
 	if err != nil {
 		od.wgpool.Error(err)
 		return
 	}
-	defer res.Body.Close()
-	// 写入到文件
-	err = od.operatFile.iocopy(res.Body, start, id, int(end-start+1))
-	if err != nil {
-		od.wgpool.Error(err)
-		return
-	}
-}
-
-// multithBreakpoint 多线程，断点续传
-func (od *operatDown) multithBreakpoint(ctx context.Context) {
-	// 执行多线程任务
-	go od.startMultithBreakpoint(ctx)
-	// 阻塞等待所有线程完成后返回结果
-	var tmperr error
-	for err := range od.wgpool.AllDone() {
-		if err != nil {
-			tmperr = err
-		} else {
-			od.finish(tmperr)
-			return
-		}
-	}
-}
-
-// startMultith 执行多线程
-func (od *operatDown) startMultithBreakpoint(ctx context.Context) {
-	var operatCF = od.operatFile.operatCF
-	// 已分配的数据块
-	for id, block := range operatCF.cf.threadblock {
-		if block.completed == (block.end-block.start)+1 {
-			continue
-		}
-		od.wgpool.Add()
-		// 中途关闭
-		if contextDone(ctx) {
-			od.wgpool.Done()
-			break
-		}
-		go od.multithSingle(ctx, id, block.start+block.completed, block.end, block.completed)
-	}
-	// 未分配的任务块
-	threadblocklen := len(operatCF.cf.threadblock)
-	startsize := operatCF.cf.threadblock[threadblocklen-1].end + 1
-	for idx, task := range threadTaskSplit(startsize, od.filesize, int64(od.config.threadSize)) {
-		od.wgpool.Add()
-		// 中途关闭
-		if contextDone(ctx) {
-			od.wgpool.Done()
-			break
-		}
-		operatCF.addTreadblock(0, task[0], task[1])
-		id := threadblocklen + idx
-		go od.multithSingle(ctx, id, task[0], task[1], 0)
-	}
-
-	od.wgpool.Syne()
+	od.blockDone()
 }
@@ -0,0 +1,59 @@
+package down
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// urlResolver 通过 Meta.URLResolver 获取会过期的下载地址
+// 所有线程共用同一个地址，地址过期时只由一个线程重新获取
+type urlResolver struct {
+	mux     sync.Mutex
+	resolve func(ctx context.Context) (string, http.Header, error)
+	maxAge  time.Duration
+	// uri 当前使用的地址和请求头
+	uri    string
+	header http.Header
+	// at 获取地址的时间
+	at time.Time
+	// gen 获取地址的次数，用于判断失效的地址是否已经重新获取过
+	gen int
+	// stale 地址已经失效，下次使用时重新获取
+	stale bool
+}
+
+// newURLResolver 创建 urlResolver，第一次使用时获取地址
+func newURLResolver(resolve func(ctx context.Context) (string, http.Header, error), maxAge time.Duration) *urlResolver {
+	return &urlResolver{resolve: resolve, maxAge: maxAge}
+}
+
+// get 获取当前的地址和请求头，没有获取过、已经失效或者超过有效时间时重新获取
+func (r *urlResolver) get(ctx context.Context) (string, http.Header, int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.gen == 0 || r.stale || (r.maxAge > 0 && time.Since(r.at) >= r.maxAge) {
+		uri, header, err := r.resolve(ctx)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		r.uri, r.header, r.at, r.stale = uri, header, time.Now(), false
+		r.gen++
+	}
+	return r.uri, r.header, r.gen, nil
+}
+
+// expire 请求返回 401、403、410 时标记第 gen 次获取的地址失效，返回 true 表示需要重新获取地址后再请求
+// 其他线程已经重新获取过地址时不再标记
+func (r *urlResolver) expire(gen int, code int) bool {
+	if code != http.StatusUnauthorized && code != http.StatusForbidden && code != http.StatusGone {
+		return false
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.gen == gen {
+		r.stale = true
+	}
+	return true
+}
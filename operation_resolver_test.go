@@ -0,0 +1,43 @@
+package down
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestURLResolver 测试地址失效和超过有效时间时重新获取，已经重新获取过的地址不再标记失效
+func TestURLResolver(t *testing.T) {
+	n := 0
+	r := newURLResolver(func(ctx context.Context) (string, http.Header, error) {
+		n++
+		return fmt.Sprintf("http://example.com/%d", n), nil, nil
+	}, time.Hour)
+	ctx := context.Background()
+
+	uri, _, gen, _ := r.get(ctx)
+	if uri != "http://example.com/1" || gen != 1 {
+		t.Fatalf("第一次获取的地址为 %s %d", uri, gen)
+	}
+	if r.expire(gen, http.StatusNotFound) {
+		t.Fatal("404 不应该重新获取地址")
+	}
+	if !r.expire(gen, http.StatusForbidden) {
+		t.Fatal("403 应该重新获取地址")
+	}
+	uri, _, gen, _ = r.get(ctx)
+	if uri != "http://example.com/2" || gen != 2 {
+		t.Fatalf("失效后获取的地址为 %s %d", uri, gen)
+	}
+	// 其他线程使用旧地址失败时不再重新获取
+	r.expire(1, http.StatusGone)
+	if uri, _, _, _ = r.get(ctx); uri != "http://example.com/2" {
+		t.Fatalf("重复获取了地址 %s", uri)
+	}
+	r.maxAge = time.Nanosecond
+	if uri, _, _, _ = r.get(ctx); uri != "http://example.com/3" {
+		t.Fatalf("超过有效时间后获取的地址为 %s", uri)
+	}
+}
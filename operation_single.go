@@ -1,82 +1,68 @@
 package down
 
-import "context"
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
 
-// single 单线程，非断点续传
-func (od *operatDown) single(ctx context.Context) {
+// single 单线程，请求整个文件，资源不支持 range 请求时暂停后恢复会重新下载
+// 支持 range 请求时读取中断后从已写入的位置继续下载
+func (od *operatDown) single(ctx context.Context) error {
 	if err := od.operatFile.file.Truncate(od.filesize); err != nil {
-		od.finish(err)
-		return
+		return err
+	}
+	atomic.StoreInt64(od.cl, 0)
+	od.operatFile.operatCF.reset()
+	if od.operatFile.hasher != nil {
+		od.operatFile.hasher.reset()
 	}
 	// 执行下载任务
 	od.wgpool.Add()
 	defer od.wgpool.Done()
-	od.operatFile.operatCF.addTreadblock(0, 0, od.filesize-1)
-	res, err := od.defaultDo(ctx, nil)
+	id := od.operatFile.operatCF.addTreadblock(0, 0, od.filesize-1)
+	res, err := od.defaultDo(ctx, od.meta.URI, nil)
 	if err != nil {
-		od.finish(err)
-		return
+		return err
 	}
 	defer res.Body.Close()
 
 	// 写入文件
-	err = od.operatFile.iocopy(res.Body, 0, 0, od.config.diskCache)
-	if err != nil {
-		od.finish(err)
-		return
+	err = od.operatFile.iocopy(ctx, res.Body, 0, id, od.config.diskCache)
+	var re *readError
+	if err == nil || !od.multithread || !errors.As(err, &re) || contextDone(ctx) {
+		return err
 	}
-
-	od.finish(nil)
+	res.Body.Close()
+	select {
+	case <-time.After(od.config.retryTime):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return od.downloadBlock(ctx, id)
 }
 
-// singleBreakpoint 单线程，断点续传
-func (od *operatDown) singleBreakpoint(ctx context.Context) {
+// singleBreakpoint 单线程，断点续传，从已有的数据块继续，未分配的部分按 threadSize 分配数据块顺序下载
+func (od *operatDown) singleBreakpoint(ctx context.Context) error {
+	if err := od.operatFile.file.Truncate(od.filesize); err != nil {
+		return err
+	}
+	operatCF := od.operatFile.operatCF
+	operatCF.resetRuntime()
 	// 执行下载任务
 	od.wgpool.Add()
 	defer od.wgpool.Done()
-	// 已分配的数据块
-	var (
-		err      error
-		operatCF = od.operatFile.operatCF
-		cf       = operatCF.cf
-	)
-	for id, block := range cf.threadblock {
-		if block.completed == (block.end-block.start)+1 {
-			continue
-		}
-		err = od.singleBreakpointBlock(ctx, id, block.start+block.completed, block.end, block.completed)
-		if err != nil {
-			od.finish(err)
-			return
+	for {
+		id, ok := operatCF.nextBlock(od.filesize, int64(od.config.threadSize))
+		if !ok {
+			return nil
 		}
-	}
-	// 未分配的任务块
-	blockallsize := cf.threadblock[len(cf.threadblock)-1].end + 1
-	if od.filesize > blockallsize {
-		od.operatFile.operatCF.addTreadblock(0, blockallsize, od.filesize-1)
-		id := len(cf.threadblock) - 1
-		err = od.singleBreakpointBlock(ctx, id, blockallsize, od.filesize-1, 0)
+		err := od.downloadBlock(ctx, id)
+		operatCF.release(id, err)
 		if err != nil {
-			od.finish(err)
-			return
+			return err
 		}
+		od.blockDone()
 	}
-	od.finish(nil)
-}
-
-// singleBreakpointBlock 断点续传单数据块
-func (od *operatDown) singleBreakpointBlock(ctx context.Context, id int, start, end, completed int64) error {
-	res, err := od.rangeDo(ctx, start, end)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-
-	// 写入到文件
-	err = od.operatFile.iocopy(res.Body, start, id, int(end-start+1))
-	if err != nil {
-		return err
-	}
-
-	return nil
 }
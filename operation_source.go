@@ -0,0 +1,150 @@
+package down
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// mirrorMaxFailures 镜像连续失败多少次后弃用
+	mirrorMaxFailures = 3
+	// mirrorSlowRatio 镜像每个连接的速度低于最快地址的几分之一时弃用
+	mirrorSlowRatio = 4
+	// mirrorSampleSize 计算地址的速度至少需要读取的数据量
+	mirrorSampleSize = 4194304
+)
+
+// source 下载地址，包括 Meta.URI 和 Meta.Mirrors
+type source struct {
+	// uri 下载地址
+	uri string
+
+	// primary 是否为 Meta.URI，主地址不会被弃用
+	primary bool
+
+	// active 正在使用该地址的连接数
+	active int
+
+	// received 从该地址读取的数据量
+	received int64
+
+	// elapsed 所有连接从该地址读取数据的总耗时
+	elapsed time.Duration
+
+	// failures 连续失败的次数
+	failures int
+
+	// dropped 是否已弃用
+	dropped bool
+}
+
+// speed 每个连接每秒读取的字节数
+func (src *source) speed() float64 {
+	if src.elapsed <= 0 {
+		return 0
+	}
+	return float64(src.received) / src.elapsed.Seconds()
+}
+
+// sources 下载地址列表，多线程下载时不同的数据块从不同的地址下载
+type sources struct {
+	list []*source
+	mux  sync.Mutex
+}
+
+// newSources 创建下载地址列表，第一个为主地址
+func newSources(uri string) *sources {
+	return &sources{list: []*source{{uri: uri, primary: true}}}
+}
+
+// add 添加镜像地址
+func (s *sources) add(uri string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.list = append(s.list, &source{uri: uri})
+}
+
+// acquire 选择一个下载地址，优先选择连接数最少的地址
+func (s *sources) acquire() *source {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var best *source
+	for _, src := range s.list {
+		if src.dropped {
+			continue
+		}
+		if best == nil || src.active < best.active {
+			best = src
+		}
+	}
+	best.active++
+	return best
+}
+
+// release 记录地址的下载结果，连续失败或者速度过慢的镜像会被弃用
+func (s *sources) release(src *source, n int64, elapsed time.Duration, failed bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	src.active--
+	src.received += n
+	src.elapsed += elapsed
+	if failed {
+		src.failures++
+	} else {
+		src.failures = 0
+	}
+	if src.primary {
+		return
+	}
+	if src.failures >= mirrorMaxFailures {
+		src.dropped = true
+		return
+	}
+	if src.received < mirrorSampleSize {
+		return
+	}
+	for _, v := range s.list {
+		if v != src && !v.dropped && v.received >= mirrorSampleSize && v.speed() > src.speed()*mirrorSlowRatio {
+			src.dropped = true
+			return
+		}
+	}
+}
+
+// checkMirrors 同时检查所有镜像地址，文件大小一致且支持 range 请求的镜像才会使用
+func (od *operatDown) checkMirrors(ctx context.Context) {
+	od.sources = newSources(od.meta.URI)
+	if !od.multithread || len(od.meta.Mirrors) == 0 {
+		return
+	}
+	ok := make([]bool, len(od.meta.Mirrors))
+	var wg sync.WaitGroup
+	for idx, uri := range od.meta.Mirrors {
+		wg.Add(1)
+		go func(idx int, uri string) {
+			defer wg.Done()
+			ok[idx] = od.checkMirror(ctx, uri)
+		}(idx, uri)
+	}
+	wg.Wait()
+	for idx, uri := range od.meta.Mirrors {
+		if ok[idx] {
+			od.sources.add(uri)
+		}
+	}
+}
+
+// checkMirror 检查镜像地址的文件大小和是否支持 range 请求
+func (od *operatDown) checkMirror(ctx context.Context, uri string) bool {
+	res, err := od.rangeDo(ctx, uri, 0, 9)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	return rangeSize(res) == od.filesize
+}
@@ -5,11 +5,13 @@ import (
 	"sync"
 )
 
-// WaitGroupPool sync.WaitGroup 池
+// WaitGroupPool sync.WaitGroup 池，线程数上限可以在运行中修改
 type WaitGroupPool struct {
-	done chan error
-	pool chan struct{}
-	wg   *sync.WaitGroup
+	done  chan error
+	size  int
+	count int
+	cond  *sync.Cond
+	wg    *sync.WaitGroup
 }
 
 // NewWaitGroupPool 创建一个 size 大小的 sync.WaitGroup 池
@@ -17,27 +19,61 @@ func NewWaitGroupPool(size int) *WaitGroupPool {
 	if size <= 0 {
 		size = math.MaxInt32
 	}
+	buffer := size
+	if buffer > 64 {
+		buffer = 64
+	}
 	return &WaitGroupPool{
-		done: make(chan error, size),
-		pool: make(chan struct{}, size),
+		done: make(chan error, buffer),
+		size: size,
+		cond: sync.NewCond(&sync.Mutex{}),
 		wg:   &sync.WaitGroup{},
 	}
 }
 
 // Count 未完成线程的个数
 func (p *WaitGroupPool) Count() int {
-	return len(p.pool)
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.count
+}
+
+// Size 线程数上限
+func (p *WaitGroupPool) Size() int {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.size
 }
 
-// Add 添加一个 sync.WaitGroup 线程
+// SetSize 修改线程数上限
+// 减少上限时已经运行的线程不受影响，未完成线程的个数低于上限后才能添加新线程
+func (p *WaitGroupPool) SetSize(size int) {
+	if size <= 0 {
+		size = math.MaxInt32
+	}
+	p.cond.L.Lock()
+	p.size = size
+	p.cond.L.Unlock()
+	p.cond.Broadcast()
+}
+
+// Add 添加一个 sync.WaitGroup 线程，达到上限时阻塞
 func (p *WaitGroupPool) Add() {
-	p.pool <- struct{}{}
+	p.cond.L.Lock()
+	for p.count >= p.size {
+		p.cond.Wait()
+	}
+	p.count++
+	p.cond.L.Unlock()
 	p.wg.Add(1)
 }
 
 // Done 完成一个 sync.WaitGroup 线程
 func (p *WaitGroupPool) Done() {
-	<-p.pool
+	p.cond.L.Lock()
+	p.count--
+	p.cond.L.Unlock()
+	p.cond.Broadcast()
 	p.wg.Done()
 }
 
@@ -0,0 +1,57 @@
+package down
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWaitGroupPoolSetSize 测试运行中修改线程数上限
+func TestWaitGroupPoolSetSize(t *testing.T) {
+	pool := NewWaitGroupPool(1)
+	pool.Add()
+
+	added := make(chan struct{})
+	go func() {
+		pool.Add()
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("达到线程数上限后不应该添加成功")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// 增加上限后阻塞的线程可以添加
+	pool.SetSize(2)
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("增加线程数上限后应该添加成功")
+	}
+	if pool.Count() != 2 {
+		t.Fatalf("线程数为 %d, 应为 2", pool.Count())
+	}
+
+	// 减少上限后已运行的线程不受影响，低于上限才能添加
+	pool.SetSize(1)
+	pool.Done()
+	added = make(chan struct{})
+	go func() {
+		pool.Add()
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("减少线程数上限后不应该添加成功")
+	case <-time.After(time.Millisecond * 50):
+	}
+	pool.Done()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("线程数低于上限后应该添加成功")
+	}
+	pool.Done()
+	pool.Wait()
+}
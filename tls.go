@@ -0,0 +1,155 @@
+package down
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// SPKIPin 计算证书公钥的 SHA-256，格式为 base64，与 curl --pinnedpubkey 的 sha256// 之后的部分一致
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SetTLSConfig 设置 TLS 配置，默认验证服务器证书
+// 使用时会拷贝一份，SetRootCAs、SetClientCertificate、SetPins 和 SetInsecureSkipVerify 的设置会在此基础上生效
+func (down *Down) SetTLSConfig(n *tls.Config) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.tlsConfig = n
+	down.resetTransport()
+}
+
+// SetRootCAs 设置验证服务器证书的根证书，为 nil 时使用系统的根证书
+func (down *Down) SetRootCAs(n *x509.CertPool) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.rootCAs = n
+	down.resetTransport()
+}
+
+// SetClientCertificate 设置客户端证书，服务器要求双向认证时使用
+func (down *Down) SetClientCertificate(n ...tls.Certificate) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.clientCerts = n
+	down.resetTransport()
+}
+
+// SetPins 设置 host 的证书公钥固定，验证通过的证书链中至少有一个证书的 SPKIPin 在 pins 中才能连接
+// pins 可以带 sha256// 前缀，为空时取消 host 的公钥固定
+// 公钥按 TLS 握手的 ServerName 检查，host 需要是域名，SetTLSConfig 固定了不同的 ServerName 时请求会返回错误
+func (down *Down) SetPins(host string, pins ...string) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	tmpPins := make(map[string][]string, len(down.pins)+1)
+	for k, v := range down.pins {
+		tmpPins[k] = v
+	}
+	if len(pins) == 0 {
+		delete(tmpPins, host)
+	} else {
+		tmpPins[host] = pins
+	}
+	down.pins = tmpPins
+	down.resetTransport()
+}
+
+// SetInsecureSkipVerify 设置是否跳过服务器证书验证，存在中间人攻击的风险，只应在测试环境中开启
+// 设置了公钥固定的 host 仍然会检查服务器证书的公钥，但只检查服务器自己的证书，不检查证书链中的其他证书
+func (down *Down) SetInsecureSkipVerify(n bool) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.insecureSkipVerify = n
+	down.resetTransport()
+}
+
+// tlsClientConfig 根据配置生成请求使用的 TLS 配置
+func (down *Down) tlsClientConfig() *tls.Config {
+	config := &tls.Config{}
+	if down.tlsConfig != nil {
+		config = down.tlsConfig.Clone()
+	}
+	if down.rootCAs != nil {
+		config.RootCAs = down.rootCAs
+	}
+	if len(down.clientCerts) > 0 {
+		config.Certificates = append(config.Certificates, down.clientCerts...)
+	}
+	if down.insecureSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	if len(down.pins) > 0 {
+		config.VerifyConnection = verifyPins(down.pins, config.VerifyConnection)
+	}
+	return config
+}
+
+// checkPinHost 检查请求地址的公钥固定能否生效
+// 公钥按 TLS 握手的 ServerName 检查，ServerName 与 host 不一致或者 host 是 IP 时无法检查，返回错误而不是跳过
+func (down *Down) checkPinHost(u *url.URL) error {
+	if u.Scheme != "https" || down.transport != nil {
+		return nil
+	}
+	host := u.Hostname()
+	if _, ok := down.pins[host]; !ok {
+		return nil
+	}
+	serverName := host
+	if down.tlsConfig != nil && down.tlsConfig.ServerName != "" {
+		serverName = down.tlsConfig.ServerName
+	}
+	if serverName != host || net.ParseIP(host) != nil {
+		return fmt.Errorf(ErrorPinHost, host, serverName)
+	}
+	return nil
+}
+
+// verifyPins 检查服务器证书链的公钥固定，next 为原有的 VerifyConnection
+func verifyPins(pins map[string][]string, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if hostPins, ok := pins[cs.ServerName]; ok && !matchPins(pinnedCerts(cs), hostPins) {
+			return fmt.Errorf(ErrorPinMismatch, cs.ServerName)
+		}
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+}
+
+// pinnedCerts 可以用于公钥固定的证书
+// PeerCertificates 是服务器发送的证书，没有经过验证，只使用验证通过的证书链
+// 跳过验证时没有证书链，只使用服务器自己的证书
+func pinnedCerts(cs tls.ConnectionState) []*x509.Certificate {
+	if len(cs.VerifiedChains) > 0 {
+		certs := make([]*x509.Certificate, 0)
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		return certs
+	}
+	if len(cs.PeerCertificates) > 0 {
+		return cs.PeerCertificates[:1]
+	}
+	return nil
+}
+
+// matchPins 证书中是否有证书的公钥在 pins 中
+func matchPins(certs []*x509.Certificate, pins []string) bool {
+	for _, cert := range certs {
+		pin := SPKIPin(cert)
+		for _, v := range pins {
+			if strings.TrimPrefix(v, "sha256//") == pin {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package down
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testTLSGet 使用 down 的 Transport 请求 https://example.com/，连接到 server
+func testTLSGet(down *Down, server *httptest.Server) error {
+	down.SetProxy(nil)
+	transport := down.newTransport()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, server.Listener.Addr().String())
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("https://example.com/")
+	if err == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+// TestTLSClientConfig 测试默认验证证书、自定义根证书、跳过验证和公钥固定
+func TestTLSClientConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	tests := []struct {
+		name string
+		set  func(down *Down)
+		ok   bool
+	}{
+		{"默认验证证书", func(down *Down) {}, false},
+		{"自定义根证书", func(down *Down) { down.SetRootCAs(pool) }, true},
+		{"跳过验证", func(down *Down) { down.SetInsecureSkipVerify(true) }, true},
+		{"公钥一致", func(down *Down) {
+			down.SetRootCAs(pool)
+			down.SetPins("example.com", "sha256//"+SPKIPin(cert))
+		}, true},
+		{"公钥不一致", func(down *Down) {
+			down.SetInsecureSkipVerify(true)
+			down.SetPins("example.com", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+		}, false},
+	}
+	for _, test := range tests {
+		down := New()
+		test.set(down)
+		// httptest 的证书包含 example.com
+		err := testTLSGet(down, server)
+		if (err == nil) != test.ok {
+			t.Fatalf("%s: 请求结果为 %v", test.name, err)
+		}
+	}
+}
+
+// TestPinsUnverifiedChain 测试服务器在证书链中附带固定的证书时不能通过公钥固定
+func TestPinsUnverifiedChain(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pinned"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.StartTLS()
+	defer server.Close()
+	// 服务器自己的证书之后附带固定的证书
+	server.TLS.Certificates[0].Certificate = append(server.TLS.Certificates[0].Certificate[:1:1], der)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	tests := []struct {
+		name string
+		set  func(down *Down)
+	}{
+		{"验证证书", func(down *Down) { down.SetRootCAs(pool) }},
+		{"跳过验证", func(down *Down) { down.SetInsecureSkipVerify(true) }},
+	}
+	for _, test := range tests {
+		down := New()
+		test.set(down)
+		down.SetPins("example.com", SPKIPin(pinned))
+		if err := testTLSGet(down, server); err == nil {
+			t.Fatalf("%s: 附带的证书通过了公钥固定", test.name)
+		}
+		down.SetPins("example.com", SPKIPin(server.Certificate()))
+		if err := testTLSGet(down, server); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+}
+
+// TestCheckPinHost 测试 ServerName 与 host 不一致或者 host 是 IP 时返回错误
+func TestCheckPinHost(t *testing.T) {
+	down := New()
+	down.SetPins("example.com", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	down.SetPins("127.0.0.1", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	tests := []struct {
+		uri        string
+		serverName string
+		ok         bool
+	}{
+		{"https://example.com/a", "", true},
+		{"http://example.com/a", "other.com", true},
+		{"https://other.com/a", "other.com", true},
+		{"https://example.com/a", "example.com", true},
+		{"https://example.com/a", "other.com", false},
+		{"https://127.0.0.1/a", "", false},
+	}
+	for _, test := range tests {
+		down.SetTLSConfig(&tls.Config{ServerName: test.serverName})
+		u, _ := url.Parse(test.uri)
+		if err := down.checkPinHost(u); (err == nil) != test.ok {
+			t.Fatalf("%s %s: %v", test.uri, test.serverName, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package down
+
+import (
+	"net/http"
+	"time"
+)
+
+// SetTransport 设置请求使用的 RoundTripper，可以用于注入测试或者统计用的 Transport
+// 为 nil 时使用 Down 内部共享的 Transport，设置后代理、超时、TLS 和连接数的设置都不再生效
+func (down *Down) SetTransport(n http.RoundTripper) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.transport = n
+}
+
+// SetMaxConnsPerHost 设置共享的 Transport 与每个 host 的最大连接数，0 为不限制
+func (down *Down) SetMaxConnsPerHost(n int) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.maxConnsPerHost = n
+	down.resetTransport()
+}
+
+// SetIdleConns 设置共享的 Transport 与每个 host 保留的最大空闲连接数和空闲连接的超时时间
+func (down *Down) SetIdleConns(n int, timeout time.Duration) {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	down.maxIdleConnsPerHost = n
+	down.idleConnTimeout = timeout
+	down.resetTransport()
+}
+
+// roundTripper 获取请求使用的 RoundTripper，没有设置时使用共享的 Transport，第一次使用时创建
+// 同一个 Down 的所有下载共享连接池，连接可以在文件之间复用
+func (down *Down) roundTripper() http.RoundTripper {
+	down.mux.Lock()
+	defer down.mux.Unlock()
+	if down.transport != nil {
+		return down.transport
+	}
+	if down.sharedTransport == nil {
+		down.sharedTransport = down.newTransport()
+	}
+	return down.sharedTransport
+}
+
+// resetTransport 修改了 Transport 相关的设置，下次使用时重新创建，需要持有锁
+// 正在使用旧 Transport 的下载不受影响
+func (down *Down) resetTransport() {
+	if down.sharedTransport != nil {
+		down.sharedTransport.CloseIdleConnections()
+		down.sharedTransport = nil
+	}
+}
+
+// newTransport 根据配置创建 Transport
+func (down *Down) newTransport() *http.Transport {
+	return &http.Transport{
+		// 应用来自环境变量的代理
+		Proxy: down.proxy,
+		// 要求服务器返回非压缩的内容，前提是没有发送 accept-encoding 来接管 transport 的自动处理
+		DisableCompression: true,
+		// 等待响应头的超时时间
+		ResponseHeaderTimeout: down.connectTimeout,
+		// TLS 握手超时时间
+		TLSHandshakeTimeout: 10 * time.Second,
+		// 默认验证服务器证书，可以设置根证书、客户端证书和公钥固定
+		TLSClientConfig: down.tlsClientConfig(),
+		// 连接数和空闲连接
+		MaxConnsPerHost:     down.maxConnsPerHost,
+		MaxIdleConnsPerHost: down.maxIdleConnsPerHost,
+		IdleConnTimeout:     down.idleConnTimeout,
+	}
+}
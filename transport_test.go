@@ -0,0 +1,28 @@
+package down
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestRoundTripper 测试拷贝的配置共享 Transport，修改设置后重新创建
+func TestRoundTripper(t *testing.T) {
+	down := New()
+	rt := down.roundTripper()
+	if down.Copy().roundTripper() != rt {
+		t.Fatal("拷贝的配置没有共享 Transport")
+	}
+	down.SetIdleConns(4, time.Second)
+	tr, ok := down.roundTripper().(*http.Transport)
+	if !ok || tr == rt {
+		t.Fatal("修改设置后没有重新创建 Transport")
+	}
+	if tr.MaxIdleConnsPerHost != 4 || tr.IdleConnTimeout != time.Second {
+		t.Fatalf("空闲连接设置为 %d %s", tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+	down.SetTransport(http.DefaultTransport)
+	if down.roundTripper() != http.DefaultTransport {
+		t.Fatal("没有使用设置的 Transport")
+	}
+}
@@ -3,15 +3,19 @@ package down
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
 	"mime"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -208,3 +212,83 @@ func contextDone(ctx context.Context) bool {
 		return false
 	}
 }
+
+// minInt 返回较小的数
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxInt 返回较大的数
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// rangeSize 从 206 响应的 Content-Range 获取文件总大小，无法获取时返回 -1
+func rangeSize(res *http.Response) int64 {
+	rangeList := strings.Split(res.Header.Get("content-range"), "/")
+	if len(rangeList) < 2 {
+		return -1
+	}
+	size, err := strconv.ParseInt(rangeList[1], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// minInt64 返回较小的数
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxInt64 返回较大的数
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// headerHash 计算请求头的 SHA-256，请求头按名称排序，名称不区分大小写
+func headerHash(header http.Header) []byte {
+	keys := make([]string, 0, len(header))
+	canonical := make(map[string][]string, len(header))
+	for k, v := range header {
+		key := http.CanonicalHeaderKey(k)
+		if _, ok := canonical[key]; !ok {
+			keys = append(keys, key)
+		}
+		canonical[key] = append(canonical[key], v...)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		for _, v := range canonical[k] {
+			fmt.Fprintf(h, "%s: %s\n", k, v)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// originURL 去掉地址中的查询参数、锚点和用户信息，签名地址的查询参数中可能有访问凭证
+func originURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
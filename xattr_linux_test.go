@@ -0,0 +1,30 @@
+//go:build linux
+
+package down
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestSetXattr 测试设置和读取文件的扩展属性
+func TestSetXattr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "down.bin")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := setXattr(path, "user.xdg.origin.url", "http://127.0.0.1/down.bin")
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("文件系统不支持扩展属性")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := getXattr(path, "user.xdg.origin.url")
+	if err != nil || value != "http://127.0.0.1/down.bin" {
+		t.Fatalf("扩展属性为 %s %v", value, err)
+	}
+}
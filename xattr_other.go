@@ -0,0 +1,15 @@
+//go:build !linux
+
+package down
+
+import "errors"
+
+// setXattr 当前系统不支持扩展属性，不做处理
+func setXattr(path, name, value string) error {
+	return nil
+}
+
+// getXattr 当前系统不支持扩展属性，返回错误
+func getXattr(path, name string) (string, error) {
+	return "", errors.New("xattr not supported")
+}